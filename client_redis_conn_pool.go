@@ -4,6 +4,9 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"time"
 
 	"github.com/FZambia/sentinel"
@@ -11,21 +14,31 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	_DefaultRedisRoleCheckIdleTime = time.Minute
+)
+
 type RedisConnPool struct {
-	db int
-	p  *redis.Pool
+	p           *redis.Pool
+	waitTimeout time.Duration
 }
 
 type RedisConnPoolConfig struct {
-	RedisEndpoint           string `json:"redis_endpoint"`
-	RedisDatabase           int    `json:"redis_database"`
-	RedisPassword           string `json:"redis_password"`
-	RedisConnectTimeout     int    `json:"redis_connect_timeout_msec"`  // 连接超时
-	RedisReadTimeout        int    `json:"redis_read_timeout_msec"`     // 读取超时
-	RedisWriteTimeout       int    `json:"redis_write_timeout_msec"`    // 写入超时
-	RedisPoolMaxIdleConns   int    `json:"redis_pool_max_idle_conns"`   // 连接池最大空闲连接数
-	RedisPoolMaxActiveConns int    `json:"redis_pool_max_active_conns"` // 连接池最大激活连接数
-	RedisOpenTLS            bool   `json:"redis_open_tls"`
+	RedisEndpoint            string `json:"redis_endpoint"`
+	RedisDatabase            int    `json:"redis_database"`
+	RedisUsername            string `json:"redis_username"`
+	RedisPassword            string `json:"redis_password"`
+	RedisConnectTimeout      int    `json:"redis_connect_timeout_msec"`        // 连接超时
+	RedisReadTimeout         int    `json:"redis_read_timeout_msec"`           // 读取超时
+	RedisWriteTimeout        int    `json:"redis_write_timeout_msec"`          // 写入超时
+	RedisPoolMaxIdleConns    int    `json:"redis_pool_max_idle_conns"`         // 连接池最大空闲连接数
+	RedisPoolMaxActiveConns  int    `json:"redis_pool_max_active_conns"`       // 连接池最大激活连接数
+	RedisPoolIdleTimeout     int    `json:"redis_pool_idle_timeout_msec"`      // 空闲连接超过该时长后被关闭 (0为不关闭)
+	RedisPoolMaxConnLifetime int    `json:"redis_pool_max_conn_lifetime_msec"` // 连接存活超过该时长后被关闭 (0为不限制)
+	RedisPoolMinIdleConns    int    `json:"redis_pool_min_idle_conns"`         // 建立连接池时预热的空闲连接数
+	RedisPoolWaitTimeout     int    `json:"redis_pool_wait_timeout_msec"`      // 连接池耗尽时等待空闲连接的超时 (0为一直等待)
+	RedisOpenTLS             bool   `json:"redis_open_tls"`
+	RedisRoleCheckIdleTime   int    `json:"redis_role_check_idle_msec"` // 连接空闲超过该时长后, 借出时才检查角色 (0为默认值, 负数为不检查)
 }
 
 // EstablishRedisConn 建立连接redis服务的TCP连接池.
@@ -33,9 +46,12 @@ func EstablishRedisConn(cfg *RedisConnPoolConfig) *RedisConnPool {
 	instance := &RedisConnPool{}
 
 	instance.p = &redis.Pool{
-		Dial: func() (redis.Conn, error) {
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
 			opts := make([]redis.DialOption, 0)
 			opts = append(opts, redis.DialDatabase(cfg.RedisDatabase))
+			if cfg.RedisUsername != "" {
+				opts = append(opts, redis.DialUsername(cfg.RedisUsername))
+			}
 			opts = append(opts, redis.DialPassword(cfg.RedisPassword))
 			if cfg.RedisConnectTimeout > 0 {
 				opts = append(opts, redis.DialConnectTimeout(time.Duration(cfg.RedisConnectTimeout)*time.Millisecond))
@@ -54,25 +70,28 @@ func EstablishRedisConn(cfg *RedisConnPoolConfig) *RedisConnPool {
 				opts = append(opts, redis.DialUseTLS(false))
 			}
 
-			conn, err := redis.DialContext(context.Background(), "tcp", cfg.RedisEndpoint, opts...)
+			conn, err := redis.DialContext(ctx, "tcp", cfg.RedisEndpoint, opts...)
 			if err != nil {
-				log.WithError(err).Fatal("failed to connect to redis server")
+				log.WithError(err).Error("failed to connect to redis server")
 				return nil, err
 			}
 			return conn, nil
 		},
-		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
-			if !sentinel.TestRole(conn, "master") {
-				return errors.New("role check failed")
-			} else {
-				return nil
-			}
-		},
-		MaxIdle:   cfg.RedisPoolMaxIdleConns,
-		MaxActive: cfg.RedisPoolMaxActiveConns,
-		Wait:      true,
+		TestOnBorrow: testRoleOnBorrow(cfg.RedisRoleCheckIdleTime),
+		MaxIdle:      cfg.RedisPoolMaxIdleConns,
+		MaxActive:    cfg.RedisPoolMaxActiveConns,
+		Wait:         true,
+	}
+	if cfg.RedisPoolIdleTimeout > 0 {
+		instance.p.IdleTimeout = time.Duration(cfg.RedisPoolIdleTimeout) * time.Millisecond
 	}
-	instance.db = cfg.RedisDatabase
+	if cfg.RedisPoolMaxConnLifetime > 0 {
+		instance.p.MaxConnLifetime = time.Duration(cfg.RedisPoolMaxConnLifetime) * time.Millisecond
+	}
+	if cfg.RedisPoolWaitTimeout > 0 {
+		instance.waitTimeout = time.Duration(cfg.RedisPoolWaitTimeout) * time.Millisecond
+	}
+	prewarmRedisPool(instance.p, cfg.RedisPoolMinIdleConns)
 	return instance
 }
 
@@ -85,27 +104,163 @@ func (p *RedisConnPool) Close() {
 
 // ExecCommand 执行redis命令, 完成后自动归还连接.
 func (p *RedisConnPool) ExecCmd(cmd string, args ...interface{}) (interface{}, error) {
-	conn, err := p.getConn()
+	return p.ExecCmdContext(context.Background(), cmd, args...)
+}
+
+// ExecCmdContext 执行redis命令, 完成后自动归还连接, 借出连接与命令执行均受ctx控制.
+func (p *RedisConnPool) ExecCmdContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := p.getConn(ctx)
 	if err != nil {
-		return nil, err
+		return nil, redisContextErr(ctx, err)
 	}
 	defer conn.Close()
-	return conn.Do(cmd, args...)
+	v, err := redis.DoContext(conn, ctx, cmd, args...)
+	return v, redisContextErr(ctx, err)
 }
 
 // ExecLuaScript 执行lua脚本, 完成后自动归还连接.
 func (p *RedisConnPool) ExecLuaScript(src string, keyCount int, keysAndArgs ...interface{}) (interface{}, error) {
-	conn, err := p.getConn()
+	return p.ExecLuaScriptContext(context.Background(), src, keyCount, keysAndArgs...)
+}
+
+// ExecLuaScriptContext 执行lua脚本, 完成后自动归还连接, 借出连接与脚本执行均受ctx控制.
+func (p *RedisConnPool) ExecLuaScriptContext(ctx context.Context, src string, keyCount int, keysAndArgs ...interface{}) (interface{}, error) {
+	conn, err := p.getConn(ctx)
 	if err != nil {
-		return nil, err
+		return nil, redisContextErr(ctx, err)
 	}
 	defer conn.Close()
 	luaScript := redis.NewScript(keyCount, src)
-	return luaScript.Do(conn, keysAndArgs...)
+	v, err := luaScript.DoContext(ctx, conn, keysAndArgs...)
+	return v, redisContextErr(ctx, err)
+}
+
+// ExecPipelineContext 在同一条连接上以流水线方式执行多条命令, 完成后自动归还连接.
+// 返回每条命令的结果, 若有命令执行出错, 则返回第一个错误.
+func (p *RedisConnPool) ExecPipelineContext(ctx context.Context, cmds ...RedisCmd) ([]interface{}, error) {
+	conn, err := p.getConn(ctx)
+	if err != nil {
+		return nil, redisContextErr(ctx, err)
+	}
+	defer conn.Close()
+	vs, err := execRedisPipeline(ctx, conn, cmds)
+	return vs, redisContextErr(ctx, err)
+}
+
+// Stats 返回连接池的统计信息.
+func (p *RedisConnPool) Stats() RedisPoolStats {
+	return newRedisPoolStats(p.p.Stats())
+}
+
+func (p *RedisConnPool) getConn(ctx context.Context) (redis.Conn, error) {
+	if p.waitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.waitTimeout)
+		defer cancel()
+	}
+	return p.p.GetContext(ctx)
+}
+
+func execRedisPipeline(ctx context.Context, conn redis.Conn, cmds []RedisCmd) ([]interface{}, error) {
+	for _, cmd := range cmds {
+		if err := conn.Send(cmd.Name, cmd.Args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		reply, err := redis.ReceiveContext(conn, ctx)
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				// 连接已不可用, 无需继续读取
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+// redisContextErr ctx到期时, 连接的读写超时可能先于ctx被察觉, 此时将网络错误包装为ctx的错误 (保留原始错误),
+// 服务端返回的错误 (如WRONGTYPE, READONLY) 原样返回.
+func redisContextErr(ctx context.Context, err error) error {
+	if err == nil || isContextErr(err) || !isNetworkErr(err) {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w: %v", ctxErr, err)
+	}
+	if dl, ok := ctx.Deadline(); ok && !time.Now().Before(dl) {
+		return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+	}
+	return err
+}
+
+// isNetworkErr 是否为网络错误或读写超时.
+func isNetworkErr(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
 
-func (p *RedisConnPool) getConn() (conn redis.Conn, err error) {
-	conn = p.p.Get()
-	_, err = conn.Do("SELECT", p.db)
-	return
+// prewarmRedisPool 预先建立n条连接并放回连接池, 避免冷启动时的建连延迟.
+func prewarmRedisPool(p *redis.Pool, n int) {
+	if n <= 0 {
+		return
+	}
+	if p.MaxIdle > 0 && n > p.MaxIdle {
+		n = p.MaxIdle
+	}
+	if p.MaxActive > 0 && n > p.MaxActive {
+		n = p.MaxActive
+	}
+	conns := make([]redis.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		conn := p.Get()
+		if err := conn.Err(); err != nil {
+			log.WithError(err).Warn("failed to prewarm redis conn pool")
+			_ = conn.Close()
+			break
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+func newRedisPoolStats(stats redis.PoolStats) RedisPoolStats {
+	return RedisPoolStats{
+		ActiveCount:  stats.ActiveCount,
+		IdleCount:    stats.IdleCount,
+		WaitCount:    stats.WaitCount,
+		WaitDuration: stats.WaitDuration,
+	}
+}
+
+// testRoleOnBorrow 返回连接池的TestOnBorrow回调, 仅对空闲超过idle毫秒的连接检查其是否仍为主节点,
+// 避免每次借出连接都多一次ROLE往返.
+func testRoleOnBorrow(idle int) func(conn redis.Conn, t time.Time) error {
+	if idle < 0 {
+		return nil
+	}
+	idleTime := _DefaultRedisRoleCheckIdleTime
+	if idle > 0 {
+		idleTime = time.Duration(idle) * time.Millisecond
+	}
+	return func(conn redis.Conn, t time.Time) error {
+		if time.Since(t) < idleTime {
+			return nil
+		}
+		if !sentinel.TestRole(conn, "master") {
+			return errors.New("role check failed")
+		}
+		return nil
+	}
 }
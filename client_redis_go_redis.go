@@ -0,0 +1,139 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// GoRedisAdapter 将go-redis的客户端 (单机, 哨兵及集群客户端) 适配为RedisConnInterface,
+// 使分布式锁可以与业务共用同一个go-redis连接池.
+type GoRedisAdapter struct {
+	c goredis.UniversalClient
+}
+
+// NewGoRedisAdapter 获取GoRedisAdapter实例, 客户端的生命周期仍由调用方管理.
+func NewGoRedisAdapter(c goredis.UniversalClient) *GoRedisAdapter {
+	return &GoRedisAdapter{
+		c: c,
+	}
+}
+
+// Close 客户端由调用方管理, 此处不做任何事情.
+func (a *GoRedisAdapter) Close() {}
+
+// ExecCmd 执行redis命令.
+func (a *GoRedisAdapter) ExecCmd(cmd string, args ...interface{}) (interface{}, error) {
+	return a.ExecCmdContext(context.Background(), cmd, args...)
+}
+
+// ExecCmdContext 执行redis命令, 受ctx控制.
+func (a *GoRedisAdapter) ExecCmdContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	v, err := goRedisResult(a.c.Do(ctx, goRedisArgs(cmd, args)...).Result())
+	return v, redisContextErr(ctx, err)
+}
+
+// ExecLuaScript 执行lua脚本.
+func (a *GoRedisAdapter) ExecLuaScript(src string, keyCount int, keysAndArgs ...interface{}) (interface{}, error) {
+	return a.ExecLuaScriptContext(context.Background(), src, keyCount, keysAndArgs...)
+}
+
+// ExecLuaScriptContext 执行lua脚本, 受ctx控制. 优先使用EVALSHA, 脚本未缓存时退化为EVAL.
+func (a *GoRedisAdapter) ExecLuaScriptContext(ctx context.Context, src string, keyCount int, keysAndArgs ...interface{}) (interface{}, error) {
+	if keyCount < 0 || keyCount > len(keysAndArgs) {
+		return nil, fmt.Errorf("invalid key count %d", keyCount)
+	}
+	keys := make([]string, keyCount)
+	for i := 0; i < keyCount; i++ {
+		keys[i] = fmt.Sprint(keysAndArgs[i])
+	}
+	v, err := goRedisResult(goredis.NewScript(src).Run(ctx, a.c, keys, keysAndArgs[keyCount:]...).Result())
+	return v, redisContextErr(ctx, err)
+}
+
+// ExecPipelineContext 以流水线方式执行多条命令, 受ctx控制, 所有命令在同一条连接上执行.
+// 集群客户端按第一个带key的命令选择节点, 不带key的命令 (如WAIT) 与之在同一个节点上执行.
+func (a *GoRedisAdapter) ExecPipelineContext(ctx context.Context, cmds ...RedisCmd) ([]interface{}, error) {
+	var c goredis.Cmdable = a.c
+	cc, isCluster := a.c.(*goredis.ClusterClient)
+	if isCluster {
+		if key := goRedisPipelineKey(cmds); key != "" {
+			// 集群的流水线按命令各自路由, 不带key的命令会被发往随机节点, 因此直接使用key所在节点的客户端
+			node, err := cc.MasterForKey(ctx, key)
+			if err != nil {
+				return nil, redisContextErr(ctx, err)
+			}
+			c = node
+		}
+	}
+	pipe := c.Pipeline()
+	results := make([]*goredis.Cmd, len(cmds))
+	for i, cmd := range cmds {
+		results[i] = pipe.Do(ctx, goRedisArgs(cmd.Name, cmd.Args)...)
+	}
+	// 每条命令的错误记录在各自的结果中
+	_, _ = pipe.Exec(ctx)
+
+	replies := make([]interface{}, len(cmds))
+	var firstErr error
+	for i, result := range results {
+		reply, err := goRedisResult(result.Result())
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		replies[i] = reply
+	}
+	if isCluster && firstErr != nil && (strings.HasPrefix(firstErr.Error(), "MOVED ") || strings.HasPrefix(firstErr.Error(), "ASK ")) {
+		// slot已迁移, 节点的客户端不会跟随重定向, 刷新集群拓扑后由调用方重试
+		cc.ReloadState(ctx)
+	}
+	return replies, redisContextErr(ctx, firstErr)
+}
+
+// Stats 返回连接池的统计信息, go-redis不统计等待空闲连接的次数及耗时, 对应字段恒为0.
+func (a *GoRedisAdapter) Stats() RedisPoolStats {
+	stats := a.c.PoolStats()
+	return RedisPoolStats{
+		ActiveCount: int(stats.TotalConns),
+		IdleCount:   int(stats.IdleConns),
+	}
+}
+
+// IsCluster 是否为集群客户端, 集群模式下LockMany要求所有key位于同一个slot.
+func (a *GoRedisAdapter) IsCluster() bool {
+	_, ok := a.c.(*goredis.ClusterClient)
+	return ok
+}
+
+// goRedisPipelineKey 返回流水线中第一个带key的命令的key, 没有时返回空字符串.
+func goRedisPipelineKey(cmds []RedisCmd) string {
+	for _, cmd := range cmds {
+		switch strings.ToUpper(cmd.Name) {
+		case "WAIT", "PING":
+		case "EVAL", "EVALSHA":
+			if len(cmd.Args) > 2 && fmt.Sprint(cmd.Args[1]) != "0" {
+				return fmt.Sprint(cmd.Args[2])
+			}
+		default:
+			if len(cmd.Args) > 0 {
+				return fmt.Sprint(cmd.Args[0])
+			}
+		}
+	}
+	return ""
+}
+
+func goRedisArgs(cmd string, args []interface{}) []interface{} {
+	return append([]interface{}{cmd}, args...)
+}
+
+// goRedisResult 与redigo保持一致, key不存在时返回nil而非错误.
+func goRedisResult(v interface{}, err error) (interface{}, error) {
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	}
+	return v, err
+}
@@ -3,7 +3,9 @@ package dlock
 import (
 	"context"
 	"crypto/tls"
-	"errors"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/FZambia/sentinel"
@@ -11,23 +13,51 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	_SentinelSwitchMasterChannel = "+switch-master"
+	_SentinelResubscribeMaxDelay = time.Second * 5
+	// 订阅连接上定期发送PING, 超过_SentinelReceiveTimeout未收到任何回复视为连接已失效
+	_SentinelPingInterval   = time.Second * 5
+	_SentinelReceiveTimeout = _SentinelPingInterval * 3
+	// redigo未导出的连接池已关闭错误
+	_RedisErrGetOnClosedPool = "redigo: get on closed pool"
+)
+
 type RedisHAConnPool struct {
-	db int
-	p  *redis.Pool
+	cfg         *RedisHAConnPoolConfig
+	sntnl       *sentinel.Sentinel
+	waitTimeout time.Duration
+
+	mu         sync.RWMutex
+	p          *redis.Pool
+	onFailover []func(oldMaster, newMaster string)
+
+	subMu sync.Mutex
+	sub   redis.Conn // 当前订阅+switch-master事件的连接
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
 }
 
 type RedisHAConnPoolConfig struct {
-	SentinelEndpoints       []string `json:"sentinel_endpoints"`
-	SentinelMasterName      string   `json:"sentinel_master_name"`
-	SentinelPassword        string   `json:"sentinel_password"`
-	SentinelOpenTLS         bool     `json:"sentinel_open_tls"`
-	RedisDatabase           int      `json:"redis_database"`
-	RedisMasterPassword     string   `json:"redis_master_password"`
-	RedisConnectTimeout     int      `json:"redis_connect_timeout_msec"`  // 连接超时
-	RedisReadTimeout        int      `json:"redis_read_timeout_msec"`     // 读取超时
-	RedisWriteTimeout       int      `json:"redis_write_timeout_msec"`    // 写入超时
-	RedisPoolMaxIdleConns   int      `json:"redis_pool_max_idle_conns"`   // 连接池最大空闲连接数
-	RedisPoolMaxActiveConns int      `json:"redis_pool_max_active_conns"` // 连接池最大激活连接数
+	SentinelEndpoints        []string `json:"sentinel_endpoints"`
+	SentinelMasterName       string   `json:"sentinel_master_name"`
+	SentinelPassword         string   `json:"sentinel_password"`
+	SentinelOpenTLS          bool     `json:"sentinel_open_tls"`
+	RedisDatabase            int      `json:"redis_database"`
+	RedisMasterUsername      string   `json:"redis_master_username"`
+	RedisMasterPassword      string   `json:"redis_master_password"`
+	RedisConnectTimeout      int      `json:"redis_connect_timeout_msec"`        // 连接超时
+	RedisReadTimeout         int      `json:"redis_read_timeout_msec"`           // 读取超时
+	RedisWriteTimeout        int      `json:"redis_write_timeout_msec"`          // 写入超时
+	RedisPoolMaxIdleConns    int      `json:"redis_pool_max_idle_conns"`         // 连接池最大空闲连接数
+	RedisPoolMaxActiveConns  int      `json:"redis_pool_max_active_conns"`       // 连接池最大激活连接数
+	RedisPoolIdleTimeout     int      `json:"redis_pool_idle_timeout_msec"`      // 空闲连接超过该时长后被关闭 (0为不关闭)
+	RedisPoolMaxConnLifetime int      `json:"redis_pool_max_conn_lifetime_msec"` // 连接存活超过该时长后被关闭 (0为不限制)
+	RedisPoolMinIdleConns    int      `json:"redis_pool_min_idle_conns"`         // 建立连接池时预热的空闲连接数
+	RedisPoolWaitTimeout     int      `json:"redis_pool_wait_timeout_msec"`      // 连接池耗尽时等待空闲连接的超时 (0为一直等待)
+	RedisRoleCheckIdleTime   int      `json:"redis_role_check_idle_msec"`        // 连接空闲超过该时长后, 借出时才检查角色 (0为默认值, 负数为不检查)
 }
 
 // EstablishRedisHAConnPool 建立连接redis服务的TCP连接池.
@@ -51,25 +81,47 @@ func EstablishRedisHAConnPool(cfg *RedisHAConnPoolConfig) *RedisHAConnPool {
 
 			conn, err := redis.DialContext(context.Background(), "tcp", addr, opts...)
 			if err != nil {
-				log.WithError(err).Fatal("failed to connect to redis server")
+				log.WithError(err).Error("failed to connect to redis server")
 				return nil, err
 			}
 			return conn, nil
 		},
 	}
 
-	instance := &RedisHAConnPool{}
-	instance.db = cfg.RedisDatabase
-	instance.p = &redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			addr, err := sntnl.MasterAddr()
+	instance := &RedisHAConnPool{
+		cfg:     cfg,
+		sntnl:   sntnl,
+		closeCh: make(chan struct{}),
+	}
+	if cfg.RedisPoolWaitTimeout > 0 {
+		instance.waitTimeout = time.Duration(cfg.RedisPoolWaitTimeout) * time.Millisecond
+	}
+	instance.p = instance.newPool()
+	prewarmRedisPool(instance.p, cfg.RedisPoolMinIdleConns)
+
+	if len(cfg.SentinelEndpoints) > 0 {
+		instance.wg.Add(1)
+		go instance.watchFailover()
+	}
+	return instance
+}
+
+// newPool 创建一个连接当前主节点的连接池.
+func (p *RedisHAConnPool) newPool() *redis.Pool {
+	cfg := p.cfg
+	pool := &redis.Pool{
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			addr, err := p.sntnl.MasterAddr()
 			if err != nil {
-				log.WithError(err).Fatal("failed to connect to redis server")
+				log.WithError(err).Error("failed to connect to redis server")
 				return nil, err
 			}
 
 			opts := make([]redis.DialOption, 0)
 			opts = append(opts, redis.DialDatabase(cfg.RedisDatabase))
+			if cfg.RedisMasterUsername != "" {
+				opts = append(opts, redis.DialUsername(cfg.RedisMasterUsername))
+			}
 			opts = append(opts, redis.DialPassword(cfg.RedisMasterPassword))
 			if cfg.RedisReadTimeout > 0 {
 				opts = append(opts, redis.DialReadTimeout(time.Duration(cfg.RedisReadTimeout)*time.Millisecond))
@@ -78,57 +130,239 @@ func EstablishRedisHAConnPool(cfg *RedisHAConnPoolConfig) *RedisHAConnPool {
 				opts = append(opts, redis.DialWriteTimeout(time.Duration(cfg.RedisWriteTimeout)*time.Millisecond))
 			}
 
-			conn, err := redis.DialContext(context.Background(), "tcp", addr, opts...)
+			conn, err := redis.DialContext(ctx, "tcp", addr, opts...)
 			if err != nil {
-				log.WithError(err).Fatal("failed to connect to redis server")
+				log.WithError(err).Error("failed to connect to redis server")
 				return nil, err
 			}
 			return conn, nil
 		},
-		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
-			if !sentinel.TestRole(conn, "master") {
-				return errors.New("role check failed")
-			} else {
-				return nil
-			}
-		},
-		MaxIdle:   cfg.RedisPoolMaxIdleConns,
-		MaxActive: cfg.RedisPoolMaxActiveConns,
-		Wait:      true,
+		TestOnBorrow: testRoleOnBorrow(cfg.RedisRoleCheckIdleTime),
+		MaxIdle:      cfg.RedisPoolMaxIdleConns,
+		MaxActive:    cfg.RedisPoolMaxActiveConns,
+		Wait:         true,
 	}
-	return instance
+	if cfg.RedisPoolIdleTimeout > 0 {
+		pool.IdleTimeout = time.Duration(cfg.RedisPoolIdleTimeout) * time.Millisecond
+	}
+	if cfg.RedisPoolMaxConnLifetime > 0 {
+		pool.MaxConnLifetime = time.Duration(cfg.RedisPoolMaxConnLifetime) * time.Millisecond
+	}
+	return pool
 }
 
 // CloseRedisConn 释放TCP连接池.
 func (p *RedisHAConnPool) Close() {
 	if p != nil {
-		_ = p.p.Close()
+		p.closeOnce.Do(func() {
+			close(p.closeCh)
+			// 中断阻塞中的订阅
+			p.subMu.Lock()
+			if p.sub != nil {
+				_ = p.sub.Close()
+			}
+			p.subMu.Unlock()
+		})
+		p.wg.Wait()
+		_ = p.pool().Close()
+		_ = p.sntnl.Close()
 	}
 }
 
+// OnFailover 注册主从切换的回调函数, 回调在连接池切换到新主节点之后被调用.
+// 切换前借出的连接上执行的命令可能已落在旧主节点上, 调用方可据此将已持有的锁视为不可信.
+func (p *RedisHAConnPool) OnFailover(fn func(oldMaster, newMaster string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onFailover = append(p.onFailover, fn)
+}
+
 // ExecCommand 执行redis命令, 完成后自动归还连接.
 func (p *RedisHAConnPool) ExecCmd(cmd string, args ...interface{}) (interface{}, error) {
-	conn, err := p.getConn()
+	return p.ExecCmdContext(context.Background(), cmd, args...)
+}
+
+// ExecCmdContext 执行redis命令, 完成后自动归还连接, 借出连接与命令执行均受ctx控制.
+func (p *RedisHAConnPool) ExecCmdContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := p.getConn(ctx)
 	if err != nil {
-		return nil, err
+		return nil, redisContextErr(ctx, err)
 	}
 	defer conn.Close()
-	return conn.Do(cmd, args...)
+	v, err := redis.DoContext(conn, ctx, cmd, args...)
+	return v, redisContextErr(ctx, err)
 }
 
 // ExecLuaScript 执行lua脚本, 完成后自动归还连接.
 func (p *RedisHAConnPool) ExecLuaScript(src string, keyCount int, keysAndArgs ...interface{}) (interface{}, error) {
-	conn, err := p.getConn()
+	return p.ExecLuaScriptContext(context.Background(), src, keyCount, keysAndArgs...)
+}
+
+// ExecLuaScriptContext 执行lua脚本, 完成后自动归还连接, 借出连接与脚本执行均受ctx控制.
+func (p *RedisHAConnPool) ExecLuaScriptContext(ctx context.Context, src string, keyCount int, keysAndArgs ...interface{}) (interface{}, error) {
+	conn, err := p.getConn(ctx)
 	if err != nil {
-		return nil, err
+		return nil, redisContextErr(ctx, err)
 	}
 	defer conn.Close()
 	luaScript := redis.NewScript(keyCount, src)
-	return luaScript.Do(conn, keysAndArgs...)
+	v, err := luaScript.DoContext(ctx, conn, keysAndArgs...)
+	return v, redisContextErr(ctx, err)
+}
+
+// ExecPipelineContext 在同一条连接上以流水线方式执行多条命令, 完成后自动归还连接.
+// 返回每条命令的结果, 若有命令执行出错, 则返回第一个错误.
+func (p *RedisHAConnPool) ExecPipelineContext(ctx context.Context, cmds ...RedisCmd) ([]interface{}, error) {
+	conn, err := p.getConn(ctx)
+	if err != nil {
+		return nil, redisContextErr(ctx, err)
+	}
+	defer conn.Close()
+	vs, err := execRedisPipeline(ctx, conn, cmds)
+	return vs, redisContextErr(ctx, err)
+}
+
+// Stats 返回连接池的统计信息.
+func (p *RedisHAConnPool) Stats() RedisPoolStats {
+	return newRedisPoolStats(p.pool().Stats())
+}
+
+func (p *RedisHAConnPool) getConn(ctx context.Context) (redis.Conn, error) {
+	if p.waitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.waitTimeout)
+		defer cancel()
+	}
+	pool := p.pool()
+	conn, err := pool.GetContext(ctx)
+	if err != nil && err.Error() == _RedisErrGetOnClosedPool {
+		// 主从切换时取到的旧连接池可能随即被关闭, 在新的连接池上重试一次
+		if cur := p.pool(); cur != pool {
+			return cur.GetContext(ctx)
+		}
+	}
+	return conn, err
+}
+
+func (p *RedisHAConnPool) pool() *redis.Pool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.p
+}
+
+// watchFailover 订阅哨兵的+switch-master事件, 订阅断开后轮流尝试其他哨兵.
+func (p *RedisHAConnPool) watchFailover() {
+	defer p.wg.Done()
+
+	delay := time.Millisecond * 100
+	for i := 0; ; i++ {
+		addr := p.cfg.SentinelEndpoints[i%len(p.cfg.SentinelEndpoints)]
+		if err := p.subscribeSwitchMaster(addr); err != nil {
+			log.WithError(err).Warnf("lost subscription to sentinel (%s)", addr)
+		} else {
+			delay = time.Millisecond * 100
+		}
+
+		select {
+		case <-p.closeCh:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > _SentinelResubscribeMaxDelay {
+			delay = _SentinelResubscribeMaxDelay
+		}
+	}
 }
 
-func (p *RedisHAConnPool) getConn() (conn redis.Conn, err error) {
-	conn = p.p.Get()
-	_, err = conn.Do("SELECT", p.db)
-	return
+func (p *RedisHAConnPool) subscribeSwitchMaster(addr string) error {
+	conn, err := p.sntnl.Dial(addr)
+	if err != nil {
+		return err
+	}
+	p.subMu.Lock()
+	select {
+	case <-p.closeCh:
+		{
+			p.subMu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+	default:
+	}
+	p.sub = conn
+	p.subMu.Unlock()
+	psc := redis.PubSubConn{Conn: conn}
+	defer func() {
+		p.subMu.Lock()
+		p.sub = nil
+		p.subMu.Unlock()
+		_ = psc.Close()
+	}()
+
+	if err = psc.Subscribe(_SentinelSwitchMasterChannel); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(_SentinelPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					// 中断阻塞中的Receive
+					_ = psc.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(_SentinelReceiveTimeout).(type) {
+		case redis.Message:
+			{
+				p.handleSwitchMaster(string(v.Data))
+			}
+		case error:
+			{
+				select {
+				case <-p.closeCh:
+					return nil
+				default:
+					return v
+				}
+			}
+		}
+	}
+}
+
+// handleSwitchMaster 处理形如"<master name> <old ip> <old port> <new ip> <new port>"的事件,
+// 用连接新主节点的连接池替换旧连接池, 旧连接池中的空闲连接立即关闭, 借出的连接在归还时关闭.
+func (p *RedisHAConnPool) handleSwitchMaster(msg string) {
+	parts := strings.Fields(msg)
+	if len(parts) != 5 || parts[0] != p.cfg.SentinelMasterName {
+		return
+	}
+	oldMaster := net.JoinHostPort(parts[1], parts[2])
+	newMaster := net.JoinHostPort(parts[3], parts[4])
+	log.Warnf("redis master switched from %s to %s", oldMaster, newMaster)
+
+	pool := p.newPool()
+	p.mu.Lock()
+	oldPool := p.p
+	p.p = pool
+	callbacks := make([]func(string, string), len(p.onFailover))
+	copy(callbacks, p.onFailover)
+	p.mu.Unlock()
+	_ = oldPool.Close()
+	prewarmRedisPool(pool, p.cfg.RedisPoolMinIdleConns)
+
+	for _, fn := range callbacks {
+		fn(oldMaster, newMaster)
+	}
 }
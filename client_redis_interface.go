@@ -1,8 +1,32 @@
 package dlock
 
+import (
+	"context"
+	"time"
+)
+
 type RedisConnInterface interface {
 	Close()
 
 	ExecCmd(cmd string, args ...interface{}) (interface{}, error)
+	ExecCmdContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error)
 	ExecLuaScript(src string, keyCount int, keysAndArgs ...interface{}) (interface{}, error)
+	ExecLuaScriptContext(ctx context.Context, src string, keyCount int, keysAndArgs ...interface{}) (interface{}, error)
+	ExecPipelineContext(ctx context.Context, cmds ...RedisCmd) ([]interface{}, error)
+
+	Stats() RedisPoolStats
+}
+
+// RedisPoolStats 连接池的统计信息.
+type RedisPoolStats struct {
+	ActiveCount  int           // 连接总数 (包括空闲连接)
+	IdleCount    int           // 空闲连接数
+	WaitCount    int64         // 等待空闲连接的总次数
+	WaitDuration time.Duration // 等待空闲连接的总耗时
+}
+
+// RedisCmd 流水线中的一条redis命令.
+type RedisCmd struct {
+	Name string
+	Args []interface{}
 }
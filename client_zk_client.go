@@ -0,0 +1,126 @@
+package dlock
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+// ZKConn 基于zookeeper的同步原语依赖的连接接口, *zk.Conn和*ZKClient都实现了该接口.
+type ZKConn interface {
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	CreateContainer(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Exists(path string) (bool, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Delete(path string, version int32) error
+}
+
+var (
+	_ ZKConn = (*zk.Conn)(nil)
+	_ ZKConn = (*ZKClient)(nil)
+)
+
+// ZKClient 托管的zookeeper连接, 可被所有基于zookeeper的同步原语安全地共享.
+// 跟踪连接状态并分发会话事件; 会话失效后客户端会自动建立新的会话, 此时重建锁服务依赖的节点.
+type ZKClient struct {
+	*zk.Conn
+
+	events *ZKSessionEvents
+	root   string
+	acl    []zk.ACL
+	state  int32 // zk.State
+
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewZKClient 建立连接并获取ZKClient实例, opts同EstablishZKConn.
+func NewZKClient(endpoints []string, timeout int64 /* in secs */, opts ...ZKConnOption) (*ZKClient, error) {
+	var o zkConnOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	conn, evCh, err := establishZKConn(endpoints, timeout, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ZKClient{
+		Conn:   conn,
+		events: NewZKSessionEvents(evCh),
+		root:   zkRootPath(conn),
+		acl:    zkACLOrDefault(o.acl),
+		state:  int32(zk.StateHasSession),
+	}
+	ch, _ := c.events.Subscribe()
+	c.wg.Add(1)
+	go c.run(ch)
+	return c, nil
+}
+
+// Close 关闭连接, 所有会话事件的订阅随之关闭.
+func (c *ZKClient) Close() {
+	c.closeOnce.Do(func() {
+		CloseZKConn(c.Conn)
+		c.wg.Wait()
+	})
+}
+
+// State 返回当前的连接状态.
+func (c *ZKClient) State() zk.State {
+	return zk.State(atomic.LoadInt32(&c.state))
+}
+
+// Events 返回会话事件的分发器, 可用于WithZKSessionEvents或自行订阅连接状态的变化.
+func (c *ZKClient) Events() *ZKSessionEvents {
+	return c.events
+}
+
+// Subscribe 订阅连接状态的变化, 同c.Events().Subscribe().
+func (c *ZKClient) Subscribe() (<-chan zk.Event, func()) {
+	return c.events.Subscribe()
+}
+
+// RootPath 返回锁服务的根路径 (含chroot).
+func (c *ZKClient) RootPath() string {
+	return c.root
+}
+
+func (c *ZKClient) run(ch <-chan zk.Event) {
+	defer c.wg.Done()
+
+	var expired bool
+	for ev := range ch {
+		atomic.StoreInt32(&c.state, int32(ev.State))
+		switch ev.State {
+		case zk.StateExpired:
+			{
+				log.Warn("zookeeper session expired, waiting for a new session")
+				expired = true
+			}
+		case zk.StateHasSession:
+			{
+				if !expired {
+					continue
+				}
+				expired = false
+				// 新的会话已经建立, 重建锁服务依赖的节点
+				bootstrap := c.root + "/" + _DlockFastLockDir
+				if err := zkCreateAll(context.Background(), c.Conn, bootstrap, c.acl); err != nil {
+					log.WithError(err).Errorf("failed to create znode <%s>", bootstrap)
+				} else {
+					log.Info("zookeeper session re-established")
+				}
+			}
+		}
+	}
+}
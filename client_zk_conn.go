@@ -2,8 +2,15 @@ package dlock
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-zookeeper/zk"
@@ -13,24 +20,150 @@ import (
 const (
 	_DefaultZKConnSessionTimeout = time.Second * 10
 	_DefaultZKConnMaxRetries     = 3
+	_ZKSessionEventsBufferSize   = 16
+	_ZKEventChanSize             = 6 // 与zk.Conn的事件通道容量一致
 
 	_DlockRootPath                   = "/dlock"
-	_DlockFastLockPath               = "/dlock/fast-lock"
-	_DlockFastLockPathPrefix         = "/dlock/fast-lock/request-"
+	_DlockFastLockDir                = "fast-lock"
 	_DlockFastLockPathShortestPrefix = "request-"
 )
 
+var (
+	// ErrInvalidZKPath zookeeper路径不合法.
+	ErrInvalidZKPath = errors.New("invalid zookeeper path")
+
+	// 通过EstablishZKConn建立的连接对应的配置, 连接关闭后删除
+	zkConnInfos sync.Map // *zk.Conn -> *zkConnInfo
+)
+
+type zkConnInfo struct {
+	root  string // 锁服务的根路径 (含chroot)
+	retry ZKRetryPolicy
+}
+
+type ZKConnConfig struct {
+	ZKEndpoints      []string `json:"zk_endpoints"`
+	ZKSessionTimeout int64    `json:"zk_session_timeout_sec"` // 会话超时
+	ZKRootPath       string   `json:"zk_root_path"`           // 锁服务的根路径
+}
+
+// ZKConnOption EstablishZKConn的可选配置.
+type ZKConnOption func(*zkConnOptions)
+
+type zkConnOptions struct {
+	auths []zkAuth
+	acl   []zk.ACL
+	root  string
+	retry *ZKRetryPolicy
+}
+
+type zkAuth struct {
+	scheme string
+	auth   []byte
+}
+
+// WithZKAuth 连接建立后通过AddAuth添加认证信息, 重连时自动重新添加.
+// scheme为digest时auth为"user:password"; 其他scheme (如sasl) 取决于服务端配置.
+func WithZKAuth(scheme string, auth []byte) ZKConnOption {
+	return func(o *zkConnOptions) {
+		o.auths = append(o.auths, zkAuth{scheme: scheme, auth: auth})
+	}
+}
+
+// WithZKDigestAuth 使用digest方式认证, 等价于WithZKAuth("digest", []byte(user+":"+password)).
+func WithZKDigestAuth(user, password string) ZKConnOption {
+	return WithZKAuth("digest", []byte(user+":"+password))
+}
+
+// WithZKConnRootPath 设置锁服务的根路径, 默认为/dlock, 不存在时逐级创建.
+// 连接地址中的chroot (如host:2181/app) 会作为根路径的前缀.
+func WithZKConnRootPath(root string) ZKConnOption {
+	return func(o *zkConnOptions) {
+		o.root = root
+	}
+}
+
+// WithZKBootstrapACL 设置创建锁服务根节点时使用的ACL, 默认为zk.WorldACL(zk.PermAll).
+func WithZKBootstrapACL(acl []zk.ACL) ZKConnOption {
+	return func(o *zkConnOptions) {
+		o.acl = acl
+	}
+}
+
+// ZKCreatorAllACL 仅创建者 (即添加了认证信息的会话) 拥有全部权限, 需配合WithZKAuth使用.
+func ZKCreatorAllACL() []zk.ACL {
+	return zk.AuthACL(zk.PermAll)
+}
+
+// ZKDigestACL 仅指定的digest用户拥有全部权限.
+func ZKDigestACL(user, password string) []zk.ACL {
+	return zk.DigestACL(zk.PermAll, user, password)
+}
+
+// ZKWorldReadableACL 在acl的基础上允许所有人读取.
+func ZKWorldReadableACL(acl []zk.ACL) []zk.ACL {
+	_acl := make([]zk.ACL, 0, len(acl)+1)
+	_acl = append(_acl, acl...)
+	return append(_acl, zk.WorldACL(zk.PermRead)...)
+}
+
+// zkACLOrDefault acl为空时返回zk.WorldACL(zk.PermAll).
+func zkACLOrDefault(acl []zk.ACL) []zk.ACL {
+	if len(acl) == 0 {
+		return zk.WorldACL(zk.PermAll)
+	}
+	return acl
+}
+
 // EstablishZKConn 建立一条连接zookeeper集群的TCP连接.
-func EstablishZKConn(endpoints []string, timeout int64 /* in secs */) (*zk.Conn, <-chan zk.Event) {
+// endpoints支持chroot形式的地址 (如host:2181/app), 此时锁服务的所有节点都位于/app之下.
+// 连接失败或无法创建锁服务依赖的节点时直接退出进程, 需要处理错误时使用NewZKClient.
+func EstablishZKConn(endpoints []string, timeout int64 /* in secs */, opts ...ZKConnOption) (*zk.Conn, <-chan zk.Event) {
+	conn, evCh, err := establishZKConn(endpoints, timeout, opts...)
+	if err != nil {
+		if _, ok := err.(zkFatalError); ok {
+			log.WithError(err).Fatal("failed to establish zookeeper connection")
+		}
+		log.WithError(err).Error("failed to establish zookeeper connection")
+		return nil, nil
+	}
+	return conn, evCh
+}
+
+// zkFatalError EstablishZKConn遇到时退出进程的错误.
+type zkFatalError struct {
+	error
+}
+
+// establishZKConn 同EstablishZKConn, 出错时返回错误.
+func establishZKConn(endpoints []string, timeout int64 /* in secs */, opts ...ZKConnOption) (*zk.Conn, <-chan zk.Event, error) {
 	rand.Seed(time.Now().UnixNano())
 
+	var o zkConnOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	hosts, chroot, err := splitZKChroot(endpoints)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid zookeeper endpoints (%v): %w", endpoints, err)
+	}
+	endpoints = hosts
+	root := _DlockRootPath
+	if o.root != "" {
+		root = strings.TrimRight(o.root, "/")
+	}
+	root = chroot + root
+	if err = validZKPath(root); err != nil {
+		return nil, nil, fmt.Errorf("invalid zookeeper root path <%s>: %w", root, err)
+	}
+
 	sessionTimeout := _DefaultZKConnSessionTimeout
 	if timeout > 0 {
 		sessionTimeout = time.Second * time.Duration(timeout)
 	}
 	conn, evCh, err := zk.Connect(endpoints, sessionTimeout)
 	if err != nil {
-		log.WithError(err).Fatalf("failed to connect to zookeeper cluster (%v)", endpoints)
+		return nil, nil, zkFatalError{fmt.Errorf("failed to connect to zookeeper cluster (%v): %w", endpoints, err)}
 	}
 
 WAIT_CONNECTED_LOOP:
@@ -42,138 +175,219 @@ WAIT_CONNECTED_LOOP:
 			}
 		case <-time.After(_DefaultZKConnSessionTimeout):
 			conn.Close()
-			log.WithError(err).Errorf("timeout to connect to zookeeper cluster (%v)", endpoints)
-			return nil, nil
+			return nil, nil, fmt.Errorf("timeout to connect to zookeeper cluster (%v)", endpoints)
 		}
 	}
 
-	zkCreateOrPanic(conn, _DlockRootPath)
-	zkCreateOrPanic(conn, _DlockFastLockPath)
-	return conn, evCh
+	for _, auth := range o.auths {
+		if err = conn.AddAuth(auth.scheme, auth.auth); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("failed to add %s auth to zookeeper cluster (%v): %w", auth.scheme, endpoints, err)
+		}
+	}
+
+	info := &zkConnInfo{root: root, retry: DefaultZKRetryPolicy()}
+	if o.retry != nil {
+		info.retry = *o.retry
+	}
+	zkConnInfos.Store(conn, info)
+	evCh = forwardZKEvents(conn, evCh)
+	path := root + "/" + _DlockFastLockDir
+	if err = zkCreateAll(context.Background(), conn, path, zkACLOrDefault(o.acl)); err != nil {
+		CloseZKConn(conn)
+		return nil, nil, zkFatalError{fmt.Errorf("failed to create znode <%s>: %w", path, err)}
+	}
+	return conn, evCh, nil
+}
+
+// forwardZKEvents 转发连接的会话事件, 连接关闭后 (包括直接调用conn.Close) 清理连接对应的配置.
+func forwardZKEvents(conn *zk.Conn, in <-chan zk.Event) <-chan zk.Event {
+	out := make(chan zk.Event, _ZKEventChanSize)
+	go func() {
+		for ev := range in {
+			select {
+			case out <- ev:
+			default:
+				// 与zk.Conn一致, 调用方消费不及时时丢弃事件
+			}
+		}
+		zkConnInfos.Delete(conn)
+		close(out)
+	}()
+	return out
 }
 
 // CloseZKConn 关闭TCP连接.
 func CloseZKConn(conn *zk.Conn) {
+	zkConnInfos.Delete(conn)
 	conn.Close()
 }
 
-// 如果ZNode不存在就创建.
-func zkCreate(conn *zk.Conn, path string) error {
-	if _, err := zkSafeCreateWithDefaultDataFilled(conn, path, 0); err != nil {
-		return err
+// zkRootPath 返回连接对应的锁服务根路径, 不是通过EstablishZKConn或NewZKClient建立的连接返回默认的/dlock.
+func zkRootPath(conn ZKConn) string {
+	if c, ok := conn.(*ZKClient); ok {
+		return c.root
 	}
-	return nil
+	if info, ok := zkConnInfos.Load(conn); ok {
+		return info.(*zkConnInfo).root
+	}
+	return _DlockRootPath
 }
 
-// 如果ZNode不存在就创建, 出错直接panic.
-func zkCreateOrPanic(conn *zk.Conn, path string) {
-	if err := zkCreate(conn, path); err != nil && err != zk.ErrNodeExists {
-		log.WithError(err).Fatalf("failed to create znode <%s>", path)
+// zkRetryPolicy 返回连接对应的重试策略, 不是通过EstablishZKConn或NewZKClient建立的连接返回默认的重试策略.
+func zkRetryPolicy(conn ZKConn) ZKRetryPolicy {
+	if c, ok := conn.(*ZKClient); ok {
+		conn = c.Conn
 	}
+	if info, ok := zkConnInfos.Load(conn); ok {
+		return info.(*zkConnInfo).retry
+	}
+	return DefaultZKRetryPolicy()
 }
 
-// 创建ZNode.
-func zkSafeCreate(conn *zk.Conn, path string, data []byte, flags int32) (string, error) {
-	var _path string
-	var _data []byte
-	var err error
-
-	var retry bool
-CREATE_LOOP:
-	for i := 0; i < _DefaultZKConnMaxRetries; i++ {
-		_path, err = conn.Create(path, data, flags, zk.WorldACL(zk.PermAll))
-		switch err {
-		case zk.ErrSessionExpired:
-			{
-				break CREATE_LOOP
-			}
-		// 连接关闭, 可能因为暂时的网络问题, 直接重试
-		case zk.ErrConnectionClosed:
-			{
-				retry = true
-				time.Sleep(time.Millisecond * time.Duration(10+rand.Intn(40)))
-				continue
-			}
-		// ZNode已存在
-		case zk.ErrNodeExists:
-			{
-				// 之前就创建过
-				if !retry {
-					err = zk.ErrNodeExists
-					break CREATE_LOOP
+// splitZKChroot 拆分chroot形式的地址, 返回不含chroot的地址及chroot, 各地址的chroot必须一致.
+func splitZKChroot(endpoints []string) ([]string, string, error) {
+	hosts := make([]string, 0, len(endpoints))
+	chroot := ""
+	for _, endpoint := range endpoints {
+		host := endpoint
+		if idx := strings.Index(endpoint, "/"); idx >= 0 {
+			host = endpoint[:idx]
+			_chroot := strings.TrimRight(endpoint[idx:], "/")
+			if _chroot != "" {
+				if err := validZKPath(_chroot); err != nil {
+					return nil, "", err
 				}
-				// 因为网络问题导致的假失败
-				_data, err = zkSafeGet(conn, path)
-				if err != nil {
-					// 又可能因为暂时的网络问题, 请重试
-					time.Sleep(time.Millisecond * time.Duration(10+rand.Intn(40)))
-					continue
+				if chroot != "" && chroot != _chroot {
+					return nil, "", ErrInvalidZKPath
 				}
-				if !bytes.Equal(data, _data) {
-					err = zk.ErrUnknown
-				}
-				break CREATE_LOOP
-			}
-		default:
-			{
-				// TODO: 处理更多的错误情形
-				break CREATE_LOOP
+				chroot = _chroot
 			}
 		}
+		hosts = append(hosts, host)
 	}
+	return hosts, chroot, nil
+}
 
-	return _path, err
+// validZKPath 校验path是否为合法的绝对路径, 根节点"/"除外.
+func validZKPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return ErrInvalidZKPath
+	}
+	return validZKRelativePath(path[1:])
+}
+
+// validZKRelativePath 校验path是否为合法的相对路径, 如a/b/c.
+func validZKRelativePath(path string) error {
+	if path == "" {
+		return ErrInvalidZKPath
+	}
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return ErrInvalidZKPath
+		}
+	}
+	return nil
+}
+
+// zkCreateAll 逐级创建path及其所有不存在的父节点.
+func zkCreateAll(ctx context.Context, conn ZKConn, path string, acl []zk.ACL) error {
+	for idx := 1; idx <= len(path); idx++ {
+		if idx != len(path) && path[idx] != '/' {
+			continue
+		}
+		if err := zkCreate(ctx, conn, path[:idx], acl); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// 如果ZNode不存在就创建.
+func zkCreate(ctx context.Context, conn ZKConn, path string, acl []zk.ACL) error {
+	if _, err := zkSafeCreateWithDefaultDataFilled(ctx, conn, path, 0, acl); err != nil {
+		return err
+	}
+	return nil
 }
 
 // 创建ZNode.
-func zkSafeCreateWithDefaultDataFilled(conn *zk.Conn, path string, flags int32) (string, error) {
+func zkSafeCreate(ctx context.Context, conn ZKConn, path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
 	var _path string
-	var _data []byte
-	var err error
 
 	var retry bool
+	err := zkRetry(ctx, conn, func() error {
+		var err error
+		_path, err = conn.Create(path, data, flags, zkACLOrDefault(acl))
+		if err != zk.ErrNodeExists || !retry {
+			// 连接断开时创建请求可能已经成功
+			retry = retry || IsZKRetryableError(err)
+			return err
+		}
+		// 因为网络问题导致的假失败
+		_data, _, err := conn.Get(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, _data) {
+			return zk.ErrUnknown
+		}
+		_path = path
+		return nil
+	})
+
+	return _path, err
+}
 
+// 创建ZNode.
+func zkSafeCreateWithDefaultDataFilled(ctx context.Context, conn ZKConn, path string, flags int32, acl []zk.ACL) (string, error) {
 	data := make([]byte, 8)
 	binary.LittleEndian.PutUint64(data, uint64(time.Now().UnixMilli()))
-CREATE_LOOP:
-	for i := 0; i < _DefaultZKConnMaxRetries; i++ {
-		_path, err = conn.Create(path, data, flags, zk.WorldACL(zk.PermAll))
-		switch err {
-		case zk.ErrSessionExpired:
-			{
-				break CREATE_LOOP
-			}
-		// 连接关闭, 可能因为暂时的网络问题, 直接重试
-		case zk.ErrConnectionClosed:
-			{
-				retry = true
-				time.Sleep(time.Millisecond * time.Duration(10+rand.Intn(40)))
-				continue
+	return zkSafeCreate(ctx, conn, path, data, flags, acl)
+}
+
+// 创建受保护的临时顺序节点, 节点名形如<prefix><guid>-<seq>.
+// 连接断开时第一次创建可能已在服务端成功, 此时先在dir下查找带有guid的节点, 找不到才重新创建,
+// 避免遗留一个永远占据队列位置的孤儿节点. data为nil时填充默认数据.
+func zkSafeCreateProtected(ctx context.Context, conn ZKConn, dir, prefix string, data []byte, acl []zk.ACL) (string, error) {
+	if data == nil {
+		data = make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, uint64(time.Now().UnixMilli()))
+	}
+	name := prefix + newZKGUID() + "-"
+
+	var _path string
+
+	var lookup bool
+	err := zkRetry(ctx, conn, func() error {
+		if lookup {
+			_children, _, err := conn.Children(dir)
+			if err != nil {
+				return err
 			}
-		// ZNode已存在
-		case zk.ErrNodeExists:
-			{
-				// 之前就创建过
-				if !retry {
-					err = zk.ErrNodeExists
-					break CREATE_LOOP
-				}
-				// 因为网络问题导致的假失败
-				_data, err = zkSafeGet(conn, path)
-				if err != nil {
-					// 又可能因为暂时的网络问题, 请重试
-					time.Sleep(time.Millisecond * time.Duration(10+rand.Intn(40)))
-					continue
+			for _, child := range _children {
+				// 之前的创建请求已经成功
+				if strings.HasPrefix(child, name) {
+					_path = dir + "/" + child
+					return nil
 				}
-				if !bytes.Equal(data, _data) {
-					err = zk.ErrUnknown
-				}
-				break CREATE_LOOP
 			}
-		default:
-			{
-				// TODO: 处理更多的错误情形
-				break CREATE_LOOP
+			lookup = false
+		}
+
+		var err error
+		_path, err = conn.Create(dir+"/"+name, data, zk.FlagEphemeral|zk.FlagSequence, zkACLOrDefault(acl))
+		// 创建请求可能已经成功, 查找后再重试
+		lookup = IsZKRetryableError(err)
+		return err
+	})
+	if err != nil && lookup {
+		// 放弃重试时创建请求可能已经成功, 尽力删除以免遗留孤儿节点
+		if _children, _, _err := conn.Children(dir); _err == nil {
+			for _, child := range _children {
+				if strings.HasPrefix(child, name) {
+					_ = conn.Delete(dir+"/"+child, -1)
+				}
 			}
 		}
 	}
@@ -181,107 +395,180 @@ CREATE_LOOP:
 	return _path, err
 }
 
+// newZKGUID 生成受保护节点名中的guid.
+func newZKGUID() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		binary.LittleEndian.PutUint64(b, rand.Uint64())
+		binary.LittleEndian.PutUint64(b[8:], uint64(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(b)
+}
+
 // 获取ZNode的值.
-func zkSafeGet(conn *zk.Conn, path string) ([]byte, error) {
+func zkSafeGet(ctx context.Context, conn ZKConn, path string) ([]byte, error) {
 	var _data []byte
-	var err error
 
-GET_LOOP:
-	for i := 0; i < _DefaultZKConnMaxRetries; i++ {
+	err := zkRetry(ctx, conn, func() error {
+		var err error
 		_data, _, err = conn.Get(path)
-		switch err {
-		case zk.ErrSessionExpired:
-			{
-				break GET_LOOP
-			}
-		// 连接关闭, 可能因为暂时的网络问题, 请重试
-		case zk.ErrConnectionClosed:
-			{
-				time.Sleep(time.Millisecond * time.Duration(10+rand.Intn(40)))
-				continue
-			}
-		default:
-			{
-				// TODO: 处理更多的错误情形
-				break GET_LOOP
-			}
-		}
-	}
+		return err
+	})
 
 	return _data, err
 }
 
-// 删除ZNode.
-func zkSafeDelete(conn *zk.Conn, path string, version int32) error {
-	var err error
+// 判断ZNode是否存在, watch为true时同时设置监听.
+func zkSafeExists(ctx context.Context, conn ZKConn, path string, watch bool) (bool, <-chan zk.Event, error) {
+	var _exists bool
+	var _watcher <-chan zk.Event
 
-	var retry bool
-DELETE_LOOP:
-	for i := 0; i < _DefaultZKConnMaxRetries; i++ {
-		err = conn.Delete(path, version)
-		switch err {
-		case zk.ErrSessionExpired:
-			{
-				break DELETE_LOOP
-			}
-		// 连接关闭, 可能因为暂时的网络问题, 请重试
-		case zk.ErrConnectionClosed:
-			{
-				retry = true
-				time.Sleep(time.Millisecond * time.Duration(10+rand.Intn(40)))
-				continue
-			}
-		// ZNode不存在
-		case zk.ErrNoNode:
-			{
-				// 因为网络问题导致的假失败
-				if !retry {
-					err = zk.ErrNoNode
-				}
-				break DELETE_LOOP
-			}
-		default:
-			{
-				// TODO: 处理更多的错误情形
-				break DELETE_LOOP
-			}
+	err := zkRetry(ctx, conn, func() error {
+		var err error
+		if watch {
+			_exists, _, _watcher, err = conn.ExistsW(path)
+		} else {
+			_exists, _, err = conn.Exists(path)
 		}
-	}
+		return err
+	})
 
-	return err
+	return _exists, _watcher, err
+}
+
+// 删除ZNode.
+func zkSafeDelete(ctx context.Context, conn ZKConn, path string, version int32) error {
+	var retry bool
+	return zkRetry(ctx, conn, func() error {
+		err := conn.Delete(path, version)
+		// ZNode不存在, 可能是因为网络问题导致的假失败
+		if err == zk.ErrNoNode && retry {
+			return nil
+		}
+		retry = retry || IsZKRetryableError(err)
+		return err
+	})
 }
 
 // 获取ZNode下所有的子节点.
-func zkSafeGetChildren(conn *zk.Conn, path string, watch bool) ([]string, <-chan zk.Event, error) {
+func zkSafeGetChildren(ctx context.Context, conn ZKConn, path string, watch bool) ([]string, <-chan zk.Event, error) {
 	var _children []string
 	var _watcher <-chan zk.Event
-	var err error
 
-GET_LOOP:
-	for i := 0; i < _DefaultZKConnMaxRetries; i++ {
+	err := zkRetry(ctx, conn, func() error {
+		var err error
 		if watch {
 			_children, _, _watcher, err = conn.ChildrenW(path)
 		} else {
 			_children, _, err = conn.Children(path)
 		}
-		switch err {
-		case zk.ErrSessionExpired:
-			{
-				break GET_LOOP
-			}
-		// 连接关闭, 可能因为暂时的网络问题, 请重试
-		case zk.ErrConnectionClosed:
-			{
-				time.Sleep(time.Millisecond * time.Duration(10+rand.Intn(40)))
-				continue
-			}
-		default:
-			{
-				// TODO: 处理更多的错误情形
-				break GET_LOOP
-			}
+		return err
+	})
+
+	return _children, _watcher, err
+}
+
+// ZKSessionEvents 将EstablishZKConn返回的事件通道分发给多个订阅者.
+// zookeeper客户端在事件通道写满时会丢弃新的事件, 因此应在建立连接后立即创建.
+type ZKSessionEvents struct {
+	mu     sync.Mutex
+	subs   map[*zkSessionSubscriber]struct{}
+	closed bool
+}
+
+// zkSessionSubscriber 会话事件的订阅者, 处理不及时时丢弃最旧的事件, 不阻塞其他订阅者.
+type zkSessionSubscriber struct {
+	mu     sync.Mutex
+	ch     chan zk.Event
+	closed bool
+}
+
+// NewZKSessionEvents 获取ZKSessionEvents实例, 事件通道关闭 (连接关闭) 后所有订阅者的通道随之关闭.
+func NewZKSessionEvents(evCh <-chan zk.Event) *ZKSessionEvents {
+	s := &ZKSessionEvents{
+		subs: make(map[*zkSessionSubscriber]struct{}),
+	}
+	go s.run(evCh)
+	return s
+}
+
+// Subscribe 订阅会话事件, 不再需要时调用返回的函数取消订阅.
+// 订阅者来不及处理时丢弃最旧的事件, 最新的会话状态总会送达.
+func (s *ZKSessionEvents) Subscribe() (<-chan zk.Event, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := &zkSessionSubscriber{
+		ch: make(chan zk.Event, _ZKSessionEventsBufferSize),
+	}
+	if s.closed {
+		sub.close()
+		return sub.ch, func() {}
+	}
+	s.subs[sub] = struct{}{}
+	return sub.ch, func() {
+		s.mu.Lock()
+		delete(s.subs, sub)
+		s.mu.Unlock()
+		sub.close()
+	}
+}
+
+func (s *ZKSessionEvents) run(evCh <-chan zk.Event) {
+	for ev := range evCh {
+		if ev.Type != zk.EventSession {
+			continue
+		}
+		// 不持有s.mu发送, 订阅者处理缓慢时不影响订阅与取消订阅
+		for _, sub := range s.subscribers() {
+			sub.send(ev)
 		}
 	}
 
-	return _children, _watcher, err
+	s.mu.Lock()
+	s.closed = true
+	subs := s.subs
+	s.subs = nil
+	s.mu.Unlock()
+	for sub := range subs {
+		sub.close()
+	}
+}
+
+func (s *ZKSessionEvents) subscribers() []*zkSessionSubscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := make([]*zkSessionSubscriber, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// send 非阻塞地发送事件, 缓冲区已满时丢弃最旧的事件.
+func (sub *zkSessionSubscriber) send(ev zk.Event) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	select {
+	case sub.ch <- ev:
+		return
+	default:
+	}
+	select {
+	case <-sub.ch:
+	default:
+	}
+	sub.ch <- ev
+}
+
+func (sub *zkSessionSubscriber) close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.ch)
+	}
 }
@@ -0,0 +1,122 @@
+package dlock
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+const (
+	_DefaultZKRetryMaxRetries     = 5
+	_DefaultZKRetryBaseBackoff    = time.Millisecond * 10
+	_DefaultZKRetryMaxBackoff     = time.Second
+	_DefaultZKRetryMaxElapsedTime = time.Second * 5
+
+	// go-zookeeper没有为以下服务端错误码定义错误值, 以"unknown error: <code>"的形式返回
+	_ZKErrConnectionLoss   = -4
+	_ZKErrUnimplemented    = -6
+	_ZKErrOperationTimeout = -7
+	_ZKErrThrottledOp      = -127 // 3.7+, 服务端过载时拒绝请求
+)
+
+// ZKRetryPolicy zookeeper操作的重试策略, 只重试IsZKRetryableError判定为可重试的错误.
+// 重试间隔从BaseBackoff开始指数增长, 不超过MaxBackoff, 并加入随机抖动以免大量客户端同时重试.
+type ZKRetryPolicy struct {
+	MaxRetries     int           // 最大重试次数, 不大于0时不限次数
+	BaseBackoff    time.Duration // 首次重试前的等待时间
+	MaxBackoff     time.Duration // 单次等待时间的上限
+	MaxElapsedTime time.Duration // 从首次执行开始的总耗时上限, 不大于0时不限
+}
+
+// DefaultZKRetryPolicy 返回默认的重试策略: 最多重试5次, 重试间隔10ms~1s, 总耗时不超过5s.
+func DefaultZKRetryPolicy() ZKRetryPolicy {
+	return ZKRetryPolicy{
+		MaxRetries:     _DefaultZKRetryMaxRetries,
+		BaseBackoff:    _DefaultZKRetryBaseBackoff,
+		MaxBackoff:     _DefaultZKRetryMaxBackoff,
+		MaxElapsedTime: _DefaultZKRetryMaxElapsedTime,
+	}
+}
+
+// WithZKRetryPolicy 设置该连接上所有zookeeper操作的重试策略, 默认为DefaultZKRetryPolicy().
+func WithZKRetryPolicy(policy ZKRetryPolicy) ZKConnOption {
+	return func(o *zkConnOptions) {
+		o.retry = &policy
+	}
+}
+
+// Do 执行fn, 返回可重试的错误时按策略重试, 直到成功, 返回不可重试的错误, 或超出重试次数及总耗时.
+// ctx被取消或超时后不再重试, 返回ctx.Err().
+func (p ZKRetryPolicy) Do(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	backoff := p.BaseBackoff
+	for retries := 0; ; retries++ {
+		err := fn()
+		if err == nil || !IsZKRetryableError(err) {
+			return err
+		}
+		if p.MaxRetries > 0 && retries >= p.MaxRetries {
+			return err
+		}
+
+		wait := p.jitter(backoff)
+		if p.MaxElapsedTime > 0 && time.Since(start)+wait > p.MaxElapsedTime {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			{
+				timer.Stop()
+				return ctx.Err()
+			}
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// jitter 在[backoff/2, backoff)之间随机选取等待时间.
+func (p ZKRetryPolicy) jitter(backoff time.Duration) time.Duration {
+	if backoff <= 1 {
+		return backoff
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)))
+}
+
+// IsZKRetryableError err是否为暂时性的错误, 重试可能成功:
+// 连接断开 (请求可能已在服务端执行成功), 暂时连接不上任何服务端, 服务端操作超时或过载限流.
+// 会话失效等其他错误重试也不会成功.
+func IsZKRetryableError(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case zk.ErrConnectionClosed, zk.ErrNoServer:
+		return true
+	}
+	return isZKErrCode(err, _ZKErrConnectionLoss) ||
+		isZKErrCode(err, _ZKErrOperationTimeout) ||
+		isZKErrCode(err, _ZKErrThrottledOp)
+}
+
+// isZKErrCode err是否为go-zookeeper未定义错误值的服务端错误码.
+func isZKErrCode(err error, code int) bool {
+	return err != nil && err.Error() == fmt.Sprintf("unknown error: %d", code)
+}
+
+// zkRetry 按conn的重试策略执行fn.
+func zkRetry(ctx context.Context, conn ZKConn, fn func() error) error {
+	return zkRetryPolicy(conn).Do(ctx, fn)
+}
@@ -0,0 +1,177 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	_CounterValueNode         = "value"
+	_CounterLockDir           = "lock"
+	_CounterOptimisticRetries = 10
+)
+
+var (
+	// ErrInvalidCounterValue 计数器节点的数据不是合法的整数.
+	ErrInvalidCounterValue = errors.New("invalid counter value")
+)
+
+// DistributedCounterByZookeeper 通过zookeeper实现的分布式原子计数器, 可用于跨服务分配唯一ID.
+// 计数值以十进制字符串保存在持久节点<root>/<name>/value中, 更新时带版本号Set, 版本冲突时乐观重试;
+// 冲突次数过多时先获取<root>/<name>/lock下的分布式锁, 持有锁期间再更新, 避免大量客户端同时空转.
+/*
+
+==> add delta
+RETRY:
+    value, version = get("<root>/<name>/value")
+    set("<root>/<name>/value", value + delta, version)
+    if version conflict:
+        goto RETRY (at most 10 times, then lock("<root>/<name>/lock") and goto RETRY)
+
+*/
+type DistributedCounterByZookeeper struct {
+	conn    ZKConn
+	base    *DlockByZookeeper
+	path    string
+	lockDir string
+}
+
+// NewDistributedCounterByZookeeper 获取名为name的DistributedCounterByZookeeper实例, 计数器不存在时创建并初始化为0,
+// opts同NewDlockByZookeeper (会话事件相关的配置不生效).
+func NewDistributedCounterByZookeeper(conn ZKConn, name string, opts ...DlockByZookeeperOption) (*DistributedCounterByZookeeper, error) {
+	base := newDlockByZookeeper(conn, opts...)
+	dir, err := base.lockDir(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &DistributedCounterByZookeeper{
+		conn:    conn,
+		base:    base,
+		path:    dir + "/" + _CounterValueNode,
+		lockDir: dir + "/" + _CounterLockDir,
+	}
+	ctx := context.Background()
+	if err = base.createLockDir(ctx, c.lockDir); err != nil {
+		log.WithField("counter", name).WithError(err).Error("failed to create counter")
+		return nil, err
+	}
+	// 计数器节点是不带目录标记的持久节点, 所在的容器节点不会被服务端回收, 也不会被空目录清理 (ReapEmptyLockDirs) 删除
+	if _, err = zkSafeCreate(ctx, conn, c.path, []byte("0"), 0, base.acl); err != nil && err != zk.ErrNodeExists {
+		log.WithField("counter", name).WithError(err).Error("failed to create counter")
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get 返回计数器当前的值.
+func (c *DistributedCounterByZookeeper) Get(ctx context.Context) (int64, error) {
+	value, _, err := c.get(ctx)
+	return value, err
+}
+
+// Add 将计数器加上delta, 返回更新后的值.
+// 连接断开时更新请求可能已经成功, 此时返回错误, 调用方重试会导致计数器多加一次 (分配的ID不连续, 但不会重复).
+func (c *DistributedCounterByZookeeper) Add(ctx context.Context, delta int64) (int64, error) {
+	value, _, err := c.update(ctx, func(current int64) (int64, bool) {
+		return current + delta, true
+	})
+	return value, err
+}
+
+// Increment 将计数器加1, 返回更新后的值.
+func (c *DistributedCounterByZookeeper) Increment(ctx context.Context) (int64, error) {
+	return c.Add(ctx, 1)
+}
+
+// CompareAndSet 计数器当前的值等于expected时更新为value, 返回是否更新成功.
+func (c *DistributedCounterByZookeeper) CompareAndSet(ctx context.Context, expected, value int64) (bool, error) {
+	_, swapped, err := c.update(ctx, func(current int64) (int64, bool) {
+		return value, current == expected
+	})
+	return swapped, err
+}
+
+// update 按fn计算的新值更新计数器, fn返回false时放弃更新. 返回更新后的值 (放弃更新时为当前的值) 及是否更新.
+// 先乐观重试, 版本冲突过多时获取分布式锁后再重试.
+func (c *DistributedCounterByZookeeper) update(ctx context.Context, fn func(current int64) (int64, bool)) (int64, bool, error) {
+	for i := 0; i < _CounterOptimisticRetries; i++ {
+		value, updated, err := c.trySet(ctx, fn)
+		if err != zk.ErrBadVersion {
+			return value, updated, err
+		}
+		// 随机等待, 错开冲突的客户端
+		timer := time.NewTimer(time.Millisecond * time.Duration(rand.Intn(10)))
+		select {
+		case <-ctx.Done():
+			{
+				timer.Stop()
+				return 0, false, ctx.Err()
+			}
+		case <-timer.C:
+		}
+	}
+
+	lockPath, err := c.base.acquire(ctx, "", c.lockDir)
+	if err != nil {
+		return 0, false, err
+	}
+	defer c.base.Unlock("", lockPath)
+	for {
+		value, updated, err := c.trySet(ctx, fn)
+		if err != zk.ErrBadVersion {
+			return value, updated, err
+		}
+		// 持有锁期间只会与仍在乐观重试的客户端冲突
+		if err = ctx.Err(); err != nil {
+			return 0, false, err
+		}
+	}
+}
+
+// trySet 读取当前的值及版本, 按版本更新一次, 版本冲突时返回zk.ErrBadVersion.
+func (c *DistributedCounterByZookeeper) trySet(ctx context.Context, fn func(current int64) (int64, bool)) (int64, bool, error) {
+	current, version, err := c.get(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	value, ok := fn(current)
+	if !ok {
+		return current, false, nil
+	}
+	// 连接断开时更新请求可能已经成功, 重试无法区分, 因此不重试
+	if _, err = c.conn.Set(c.path, []byte(strconv.FormatInt(value, 10)), version); err != nil {
+		if err != zk.ErrBadVersion {
+			log.WithField("counter", c.path).WithError(err).Error("failed to update counter")
+		}
+		return 0, false, err
+	}
+	return value, true, nil
+}
+
+// get 读取计数器当前的值及版本.
+func (c *DistributedCounterByZookeeper) get(ctx context.Context) (int64, int32, error) {
+	var data []byte
+	var stat *zk.Stat
+	err := zkRetry(ctx, c.conn, func() error {
+		var err error
+		data, stat, err = c.conn.Get(c.path)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(data) == 0 {
+		return 0, stat.Version, nil
+	}
+	value, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, 0, ErrInvalidCounterValue
+	}
+	return value, stat.Version, nil
+}
@@ -1,16 +1,25 @@
 package dlock
 
 import (
+	"context"
 	"crypto/rc4"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	_DlockRedisKey = "dlock"
+	_DlockRedisKey          = "dlock"
+	_DefaultRedisLockExpire = 30000
+
+	// 锁已被持有时两次尝试之间的等待时间, 指数增长并加入随机抖动
+	_RedisLockMinBackoff = time.Millisecond * 10
+	_RedisLockMaxBackoff = time.Millisecond * 200
 
 	// -1: failed to get; 0: failed to del;  1: success to del
 	_CheckAndDel = `if redis.call('get', KEYS[1]) == ARGV[1] then
@@ -18,18 +27,81 @@ const (
 else
 	return -1
 end`
+
+	// -1: failed to get; 0: failed to expire;  1: success to expire
+	_CheckAndPExpire = `if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('pexpire', KEYS[1], ARGV[2])
+else
+	return -1
+end`
+
+	// 0: some of keys exist; 1: success to set all keys
+	_CheckAndSetAll = `for i = 1, #KEYS do
+	if redis.call('exists', KEYS[i]) == 1 then
+		return 0
+	end
+end
+for i = 1, #KEYS do
+	redis.call('set', KEYS[i], ARGV[1], 'PX', ARGV[2])
+end
+return 1`
+
+	// number of keys deleted
+	_CheckAndDelAll = `local n = 0
+for i = 1, #KEYS do
+	if redis.call('get', KEYS[i]) == ARGV[1] then
+		n = n + redis.call('del', KEYS[i])
+	end
+end
+return n`
+)
+
+var (
+	// ErrCrossSlot 集群模式下LockMany的key不在同一个slot.
+	ErrCrossSlot = errors.New("keys don't hash to the same slot")
 )
 
 // DlockByRedis 通过redis实现的分布式锁服务
 type DlockByRedis struct {
 	rdb    RedisConnInterface
 	cipher *rc4.Cipher
+
+	defaultExpire     int64
+	replicaAck        int
+	replicaAckTimeout time.Duration
+}
+
+// DlockByRedisOption DlockByRedis的可选配置.
+type DlockByRedisOption func(*DlockByRedis)
+
+// WithDefaultExpire 设置锁的默认过期时间 (in milliseconds), 未指定过期时间时使用, 默认为30秒.
+func WithDefaultExpire(expire int64) DlockByRedisOption {
+	return func(dlr *DlockByRedis) {
+		if expire > 0 {
+			dlr.defaultExpire = expire
+		}
+	}
+}
+
+// WithReplicaAck 获取, 续期和释放锁之后, 在同一条连接上执行WAIT, 等待至少numReplicas个从节点确认写入,
+// 最多等待timeout (0表示一直等待). 用于缩小哨兵主从切换时刚写入的锁丢失的窗口.
+//
+// 获取锁时若确认的从节点不足, 会回滚并视为未获取到锁; 续期时视为续期失败; 释放时仅记录日志.
+func WithReplicaAck(numReplicas int, timeout time.Duration) DlockByRedisOption {
+	return func(dlr *DlockByRedis) {
+		dlr.replicaAck = numReplicas
+		dlr.replicaAckTimeout = timeout
+	}
 }
 
 // NewDlockByRedis 获取DlockByRedis实例.
-func NewDlockByRedis(rdb RedisConnInterface) *DlockByRedis {
+func NewDlockByRedis(rdb RedisConnInterface, opts ...DlockByRedisOption) *DlockByRedis {
 	inst := &DlockByRedis{
-		rdb: rdb,
+		rdb:           rdb,
+		defaultExpire: _DefaultRedisLockExpire,
+	}
+	for _, opt := range opts {
+		opt(inst)
 	}
 	key := make([]byte, 32)
 	rand.Read(key)
@@ -39,30 +111,50 @@ func NewDlockByRedis(rdb RedisConnInterface) *DlockByRedis {
 
 // TryLock 尝试获取分布式锁, 超时后就放弃 (不可重入锁).
 func (dlr *DlockByRedis) TryLock(pid string, expire /* in milliseconds  */, timeout int64 /* in seconds */) (token string, acquired bool) {
-	if expire <= 0 {
-		expire = 30000
-	}
 	if timeout <= 0 {
 		timeout = 1
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	return dlr.TryLockContext(ctx, pid, expire)
+}
+
+// TryLockContext 尝试获取分布式锁, ctx被取消或超时后就放弃 (不可重入锁).
+func (dlr *DlockByRedis) TryLockContext(ctx context.Context, pid string, expire int64 /* in milliseconds  */) (token string, acquired bool) {
+	if expire <= 0 {
+		expire = dlr.defaultExpire
+	}
 
 	rv := dlr.random()
-	timeout = time.Now().Unix() + timeout
+	backoff := _RedisLockMinBackoff
 
 LOOP:
 	for {
-		v, err := dlr.rdb.ExecCmd("SET", _DlockRedisKey, rv, "NX", "PX", expire)
+		v, replicated, err := dlr.exec(ctx, RedisCmd{Name: "SET", Args: []interface{}{_DlockRedisKey, rv, "NX", "PX", expire}})
 		if err != nil {
-			log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
+			if isContextErr(err) {
+				log.WithField("pid", pid).Warn("timeout to acquire lock")
+				// 被取消的SET可能已经发出, 尽力回滚
+				dlr.rollback(pid, []interface{}{_DlockRedisKey}, rv)
+			} else {
+				log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
+			}
 			acquired = false
 			break LOOP
 		}
 		if v != nil && v.(string) == "OK" {
+			if !replicated {
+				log.WithField("pid", pid).Warn("not enough replicas acknowledged lock, roll back")
+				dlr.rollback(pid, []interface{}{_DlockRedisKey}, rv)
+				acquired = false
+				break LOOP
+			}
 			token = rv
 			acquired = true
 			break LOOP
 		}
-		if time.Now().Unix() > timeout {
+		// 锁已被持有, 等待一段时间后重试, 避免空转
+		if !redisWaitBackoff(ctx, &backoff) {
 			log.WithField("pid", pid).Warn("timeout to acquire lock")
 			acquired = false
 			break LOOP
@@ -74,12 +166,174 @@ LOOP:
 
 // Unlock 释放分布式锁.
 func (dlr *DlockByRedis) Unlock(pid, token string) {
-	v, err := dlr.rdb.ExecLuaScript(_CheckAndDel, 1, _DlockRedisKey, token)
+	dlr.UnlockContext(context.Background(), pid, token)
+}
+
+// UnlockContext 释放分布式锁, 受ctx控制.
+func (dlr *DlockByRedis) UnlockContext(ctx context.Context, pid, token string) {
+	v, replicated, err := dlr.exec(ctx, RedisCmd{Name: "EVAL", Args: []interface{}{_CheckAndDel, 1, _DlockRedisKey, token}})
 	if err != nil {
 		log.WithField("pid", pid).WithError(err).Error("failed to release lock")
 	}
 	if v == nil || v.(int64) != 1 {
 		log.WithField("pid", pid).WithError(err).Error("failed to release lock")
+		return
+	}
+	if !replicated {
+		log.WithField("pid", pid).Warn("not enough replicas acknowledged lock release")
+	}
+}
+
+// Extend 将分布式锁的过期时间重置为expire毫秒, 仅当锁仍由token持有时成功.
+func (dlr *DlockByRedis) Extend(pid, token string, expire int64 /* in milliseconds  */) (extended bool) {
+	return dlr.ExtendContext(context.Background(), pid, token, expire)
+}
+
+// ExtendContext 将分布式锁的过期时间重置为expire毫秒, 仅当锁仍由token持有时成功, 受ctx控制.
+func (dlr *DlockByRedis) ExtendContext(ctx context.Context, pid, token string, expire int64 /* in milliseconds  */) (extended bool) {
+	if expire <= 0 {
+		expire = dlr.defaultExpire
+	}
+
+	v, replicated, err := dlr.exec(ctx, RedisCmd{Name: "EVAL", Args: []interface{}{_CheckAndPExpire, 1, _DlockRedisKey, token, expire}})
+	if err != nil {
+		log.WithField("pid", pid).WithError(err).Error("failed to extend lock")
+		return false
+	}
+	if v == nil || v.(int64) != 1 {
+		log.WithField("pid", pid).Warn("failed to extend lock, lock is not held")
+		return false
+	}
+	if !replicated {
+		log.WithField("pid", pid).Warn("not enough replicas acknowledged lock extension")
+		return false
+	}
+	return true
+}
+
+// LockMany 一次性获取names对应的所有分布式锁, 要么全部获取, 要么一把都不获取, ctx被取消或超时后就放弃.
+// 所有锁通过一个lua脚本原子地获取, 过期时间为默认过期时间.
+// 集群模式下所有锁的key必须位于同一个slot, 可以通过hash tag (如"{account}:1"与"{account}:2") 保证.
+func (dlr *DlockByRedis) LockMany(ctx context.Context, names ...string) (*MultiLock, error) {
+	names, err := normalizeLockNames(names)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]interface{}, len(names))
+	for i, name := range names {
+		keys[i] = _DlockRedisKey + ":" + name
+	}
+	if c, ok := dlr.rdb.(interface{ IsCluster() bool }); ok && c.IsCluster() {
+		slot := redisHashSlot(keys[0].(string))
+		for _, key := range keys[1:] {
+			if redisHashSlot(key.(string)) != slot {
+				return nil, ErrCrossSlot
+			}
+		}
+	}
+
+	rv := dlr.random()
+	args := append([]interface{}{_CheckAndSetAll, len(keys)}, keys...)
+	args = append(args, rv, dlr.defaultExpire)
+	backoff := _RedisLockMinBackoff
+	for {
+		v, replicated, err := dlr.exec(ctx, RedisCmd{Name: "EVAL", Args: args})
+		if err != nil {
+			if isContextErr(err) {
+				log.WithField("locks", names).Warn("timeout to acquire locks")
+				// 被取消的脚本可能已经发出, 尽力回滚
+				dlr.rollback("", keys, rv)
+				return nil, err
+			}
+			log.WithField("locks", names).WithError(err).Error("failed to acquire locks")
+			return nil, err
+		}
+		if n, _ := v.(int64); n == 1 {
+			if !replicated {
+				log.WithField("locks", names).Warn("not enough replicas acknowledged locks, roll back")
+				dlr.rollback("", keys, rv)
+				return nil, ErrNotEnoughReplicas
+			}
+			return &MultiLock{
+				names: names,
+				unlock: func(ctx context.Context) error {
+					return dlr.unlockMany(ctx, keys, rv)
+				},
+			}, nil
+		}
+
+		// 部分锁已被持有, 等待一段时间后重试, 避免空转
+		if !redisWaitBackoff(ctx, &backoff) {
+			log.WithField("locks", names).Warn("timeout to acquire locks")
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// redisWaitBackoff 等待[backoff/2, backoff)内的随机时长并将backoff翻倍, ctx结束时返回false.
+func redisWaitBackoff(ctx context.Context, backoff *time.Duration) bool {
+	timer := time.NewTimer(*backoff/2 + time.Duration(rand.Int63n(int64(*backoff/2))))
+	defer timer.Stop()
+	if *backoff *= 2; *backoff > _RedisLockMaxBackoff {
+		*backoff = _RedisLockMaxBackoff
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (dlr *DlockByRedis) unlockMany(ctx context.Context, keys []interface{}, token string) error {
+	args := append([]interface{}{_CheckAndDelAll, len(keys)}, keys...)
+	args = append(args, token)
+	v, replicated, err := dlr.exec(ctx, RedisCmd{Name: "EVAL", Args: args})
+	if err != nil {
+		log.WithError(err).Error("failed to release locks")
+		return err
+	}
+	if n, _ := v.(int64); n != int64(len(keys)) {
+		log.Errorf("failed to release locks, only %d of %d locks were held", n, len(keys))
+		return fmt.Errorf("only %d of %d locks were held", n, len(keys))
+	}
+	if !replicated {
+		log.Warn("not enough replicas acknowledged locks release")
+		return ErrNotEnoughReplicas
+	}
+	return nil
+}
+
+// exec 执行cmd (EVAL命令的参数为脚本, key的个数, key和参数).
+// 开启从节点确认时, 在同一条连接上紧随其后执行WAIT, 并返回确认的从节点是否足够.
+func (dlr *DlockByRedis) exec(ctx context.Context, cmd RedisCmd) (v interface{}, replicated bool, err error) {
+	if dlr.replicaAck <= 0 {
+		if cmd.Name == "EVAL" {
+			v, err = dlr.rdb.ExecLuaScriptContext(ctx, cmd.Args[0].(string), cmd.Args[1].(int), cmd.Args[2:]...)
+		} else {
+			v, err = dlr.rdb.ExecCmdContext(ctx, cmd.Name, cmd.Args...)
+		}
+		return v, true, err
+	}
+
+	vs, err := dlr.rdb.ExecPipelineContext(ctx, cmd, RedisCmd{
+		Name: "WAIT",
+		Args: []interface{}{dlr.replicaAck, dlr.replicaAckTimeout.Milliseconds()},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	n, _ := vs[1].(int64)
+	return vs[0], n >= int64(dlr.replicaAck), nil
+}
+
+// rollback 回滚未被足够从节点确认或者获取时被取消的锁.
+func (dlr *DlockByRedis) rollback(pid string, keys []interface{}, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	keysAndArgs := append(append([]interface{}{}, keys...), token)
+	if _, err := dlr.rdb.ExecLuaScriptContext(ctx, _CheckAndDelAll, len(keys), keysAndArgs...); err != nil {
+		log.WithField("pid", pid).WithError(err).Error("failed to roll back lock")
 	}
 }
 
@@ -90,3 +344,33 @@ func (dlr *DlockByRedis) random() string {
 	dlr.cipher.XORKeyStream(dst, src)
 	return hex.EncodeToString(dst)
 }
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// redisHashSlot 计算key在redis集群中的slot, 支持hash tag.
+func redisHashSlot(key string) uint16 {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return crc16(key) % 16384
+}
+
+// crc16 CRC16-CCITT (XMODEM), 与redis集群使用的算法一致.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -1,33 +1,87 @@
 package dlock
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/gomodule/redigo/redis"
 	"github.com/petermattis/goid"
+	goredis "github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 )
 
 var (
-	fakeRedisConnPoolConfig = &RedisConnPoolConfig{
-		RedisEndpoint:       "127.0.0.1:6379",
+	fakeRedisPassword = "sOmE_sEcUrE_pAsS"
+)
+
+// fakeRedis 基于miniredis的redis替身, 补充了miniredis未实现的ROLE和WAIT命令.
+type fakeRedis struct {
+	*miniredis.Miniredis
+	role     atomic.Value // string
+	replicas int64
+}
+
+func newFakeRedis(t testing.TB) *fakeRedis {
+	m := miniredis.RunT(t)
+	m.RequireAuth(fakeRedisPassword)
+
+	fr := &fakeRedis{Miniredis: m}
+	fr.role.Store("master")
+	_ = m.Server().Register("ROLE", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(3)
+		c.WriteBulk(fr.role.Load().(string))
+		c.WriteInt(0)
+		c.WriteLen(0)
+	})
+	_ = m.Server().Register("WAIT", func(c *server.Peer, cmd string, args []string) {
+		c.WriteInt(int(atomic.LoadInt64(&fr.replicas)))
+	})
+	return fr
+}
+
+func (fr *fakeRedis) connPoolConfig() *RedisConnPoolConfig {
+	return &RedisConnPoolConfig{
+		RedisEndpoint:       fr.Addr(),
 		RedisDatabase:       0,
-		RedisPassword:       "sOmE_sEcUrE_pAsS",
+		RedisPassword:       fakeRedisPassword,
 		RedisConnectTimeout: 2000,
 		RedisReadTimeout:    1000,
 		RedisWriteTimeout:   1000,
 	}
-)
+}
 
-func TestDlockByRedis(t *testing.T) {
-	SkipAutoTest(t)
+// fakeSentinel 基于miniredis的哨兵替身, 仅实现了SENTINEL get-master-addr-by-name.
+type fakeSentinel struct {
+	*miniredis.Miniredis
+	master atomic.Value // string
+}
+
+func newFakeSentinel(t testing.TB, master string) *fakeSentinel {
+	fs := &fakeSentinel{Miniredis: miniredis.RunT(t)}
+	fs.master.Store(master)
+	_ = fs.Server().Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		host, port, _ := net.SplitHostPort(fs.master.Load().(string))
+		c.WriteStrings([]string{host, port})
+	})
+	return fs
+}
 
+func TestDlockByRedis(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
 
-	conn := EstablishRedisConn(fakeRedisConnPoolConfig)
+	fr := newFakeRedis(t)
+	conn := EstablishRedisConn(fr.connPoolConfig())
 	defer conn.Close()
 
 	total := 0
@@ -57,3 +111,320 @@ func TestDlockByRedis(t *testing.T) {
 
 	assert.Equal(t, 20, total)
 }
+
+func TestDlockByRedisExpire(t *testing.T) {
+	fr := newFakeRedis(t)
+	conn := EstablishRedisConn(fr.connPoolConfig())
+	defer conn.Close()
+
+	dl := NewDlockByRedis(conn)
+	token1, acquired := dl.TryLock("p1", 1000, 1)
+	assert.True(t, acquired)
+	assert.Equal(t, time.Millisecond*1000, fr.TTL(_DlockRedisKey))
+
+	fr.FastForward(time.Millisecond * 1001)
+	token2, acquired := dl.TryLock("p2", 1000, 1)
+	assert.True(t, acquired)
+
+	// 过期的持有者既不能续期也不能释放别人持有的锁
+	assert.False(t, dl.Extend("p1", token1, 1000))
+	dl.Unlock("p1", token1)
+	v, _ := fr.Get(_DlockRedisKey)
+	assert.Equal(t, token2, v)
+
+	assert.True(t, dl.Extend("p2", token2, 5000))
+	assert.Equal(t, time.Millisecond*5000, fr.TTL(_DlockRedisKey))
+
+	// 锁已被持有时, 两次尝试之间有退避, 不会空转
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	before := fr.CommandCount()
+	_, acquired = dl.TryLockContext(ctx, "p3", 1000)
+	assert.False(t, acquired)
+	assert.Less(t, fr.CommandCount()-before, 30)
+
+	dl.Unlock("p2", token2)
+	assert.False(t, fr.Exists(_DlockRedisKey))
+}
+
+func TestDlockByRedisWithReplicaAck(t *testing.T) {
+	fr := newFakeRedis(t)
+	conn := EstablishRedisConn(fr.connPoolConfig())
+	defer conn.Close()
+
+	dl := NewDlockByRedis(conn, WithReplicaAck(1, time.Millisecond*100))
+	_, acquired := dl.TryLock("p1", 30000, 1)
+	assert.False(t, acquired)
+	// 未被从节点确认的锁已回滚
+	assert.False(t, fr.Exists(_DlockRedisKey))
+
+	atomic.StoreInt64(&fr.replicas, 1)
+	token, acquired := dl.TryLock("p1", 30000, 1)
+	assert.True(t, acquired)
+	assert.True(t, dl.Extend("p1", token, 30000))
+	atomic.StoreInt64(&fr.replicas, 0)
+	assert.False(t, dl.Extend("p1", token, 30000))
+	dl.Unlock("p1", token)
+	assert.False(t, fr.Exists(_DlockRedisKey))
+}
+
+func TestDlockByRedisWithGoRedis(t *testing.T) {
+	fr := newFakeRedis(t)
+	client := goredis.NewUniversalClient(&goredis.UniversalOptions{
+		Addrs:    []string{fr.Addr()},
+		Password: fakeRedisPassword,
+	})
+	defer client.Close()
+
+	pid := fmt.Sprintf("%d", goid.Get())
+	dl := NewDlockByRedis(NewGoRedisAdapter(client))
+
+	token, acquired := dl.TryLock(pid, 30000, 2)
+	assert.True(t, acquired)
+	assert.True(t, dl.Extend(pid, token, 30000))
+	dl.Unlock(pid, token)
+	token, acquired = dl.TryLock(pid, 30000, 2)
+	assert.True(t, acquired)
+	_, acquired = dl.TryLock(pid, 30000, 1)
+	assert.False(t, acquired)
+	dl.Unlock(pid, token)
+}
+
+func TestDlockByRedisWithGoRedisClusterReplicaAck(t *testing.T) {
+	fr1 := newFakeRedis(t)
+	fr2 := newFakeRedis(t)
+	client := goredis.NewClusterClient(&goredis.ClusterOptions{
+		Password: fakeRedisPassword,
+		// go-redis将WAIT的第一个参数当作key路由, "1"位于slot 9842, "dlock"位于slot 13012
+		ClusterSlots: func(ctx context.Context) ([]goredis.ClusterSlot, error) {
+			return []goredis.ClusterSlot{
+				{Start: 0, End: 9999, Nodes: []goredis.ClusterNode{{Addr: fr1.Addr()}}},
+				{Start: 10000, End: 16383, Nodes: []goredis.ClusterNode{{Addr: fr2.Addr()}}},
+			}, nil
+		},
+	})
+	defer client.Close()
+
+	// 只有锁所在的节点有从节点确认, WAIT被发往其他节点时加锁失败
+	node, err := client.MasterForKey(context.Background(), _DlockRedisKey)
+	assert.Nil(t, err)
+	if node.Options().Addr == fr1.Addr() {
+		atomic.StoreInt64(&fr1.replicas, 1)
+	} else {
+		atomic.StoreInt64(&fr2.replicas, 1)
+	}
+
+	dl := NewDlockByRedis(NewGoRedisAdapter(client), WithReplicaAck(1, time.Millisecond*100))
+	token, acquired := dl.TryLock("p1", 30000, 1)
+	assert.True(t, acquired)
+	assert.True(t, dl.Extend("p1", token, 30000))
+	dl.Unlock("p1", token)
+	assert.False(t, fr1.Exists(_DlockRedisKey) || fr2.Exists(_DlockRedisKey))
+}
+
+func TestDlockByRedisWithHAConnPool(t *testing.T) {
+	fr1 := newFakeRedis(t)
+	fr2 := newFakeRedis(t)
+	fs := newFakeSentinel(t, fr1.Addr())
+
+	conn := EstablishRedisHAConnPool(&RedisHAConnPoolConfig{
+		SentinelEndpoints:      []string{fs.Addr()},
+		SentinelMasterName:     "mymaster",
+		RedisMasterPassword:    fakeRedisPassword,
+		RedisConnectTimeout:    2000,
+		RedisReadTimeout:       1000,
+		RedisWriteTimeout:      1000,
+		RedisRoleCheckIdleTime: 10,
+	})
+	defer conn.Close()
+
+	failovers := make(chan string, 1)
+	conn.OnFailover(func(oldMaster, newMaster string) {
+		failovers <- oldMaster + "->" + newMaster
+	})
+
+	dl := NewDlockByRedis(conn)
+	token, acquired := dl.TryLock("p1", 30000, 1)
+	assert.True(t, acquired)
+	dl.Unlock("p1", token)
+
+	// 主节点降级后, 空闲的连接在借出时未通过角色检查而被丢弃, 重新连接新的主节点
+	fr1.role.Store("slave")
+	fs.master.Store(fr2.Addr())
+	time.Sleep(time.Millisecond * 20)
+	token, acquired = dl.TryLock("p1", 30000, 1)
+	assert.True(t, acquired)
+	assert.False(t, fr1.Exists(_DlockRedisKey))
+	assert.True(t, fr2.Exists(_DlockRedisKey))
+	dl.Unlock("p1", token)
+
+	// 哨兵发布+switch-master事件后, 连接池立即切换
+	_, port, _ := net.SplitHostPort(fr2.Addr())
+	newPort, _ := strconv.Atoi(port)
+	assert.Eventually(t, func() bool {
+		return fs.Publish(_SentinelSwitchMasterChannel,
+			fmt.Sprintf("mymaster 127.0.0.1 %s 127.0.0.1 %d", port, newPort)) > 0
+	}, time.Second, time.Millisecond*10)
+	select {
+	case ev := <-failovers:
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%s->127.0.0.1:%d", port, newPort), ev)
+	case <-time.After(time.Second):
+		t.Fatal("failover callback not called")
+	}
+	assert.Equal(t, 0, conn.Stats().IdleCount)
+
+	// 关闭连接池时同时关闭订阅连接, 不会阻塞在订阅上
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked on sentinel subscription")
+	}
+	assert.Eventually(t, func() bool {
+		return fs.Publish(_SentinelSwitchMasterChannel, "mymaster") == 0
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestRedisHAConnPoolSwitchMasterWhileWaiting(t *testing.T) {
+	fr := newFakeRedis(t)
+	fs := newFakeSentinel(t, fr.Addr())
+
+	conn := EstablishRedisHAConnPool(&RedisHAConnPoolConfig{
+		SentinelEndpoints:       []string{fs.Addr()},
+		SentinelMasterName:      "mymaster",
+		RedisMasterPassword:     fakeRedisPassword,
+		RedisConnectTimeout:     2000,
+		RedisReadTimeout:        1000,
+		RedisWriteTimeout:       1000,
+		RedisPoolMaxActiveConns: 1,
+	})
+	defer conn.Close()
+
+	// 占用旧连接池唯一的连接, 使下一次借出阻塞在旧连接池上
+	held, err := conn.getConn(context.Background())
+	assert.Nil(t, err)
+	result := make(chan error, 1)
+	go func() {
+		_, err := conn.ExecCmd("PING")
+		result <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	// 旧连接池被关闭, 阻塞的借出应在新的连接池上重试
+	host, port, _ := net.SplitHostPort(fr.Addr())
+	conn.handleSwitchMaster(fmt.Sprintf("mymaster %s %s %s %s", host, port, host, port))
+	select {
+	case err = <-result:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("get conn blocked after master switched")
+	}
+	held.Close()
+}
+
+func TestDlockByRedisLockMany(t *testing.T) {
+	fr := newFakeRedis(t)
+	conn := EstablishRedisConn(fr.connPoolConfig())
+	defer conn.Close()
+
+	dl := NewDlockByRedis(conn)
+	ml, err := dl.LockMany(context.Background(), "b", "a", "b")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b"}, ml.Names())
+	assert.Nil(t, ml.Unlock(context.Background()))
+	assert.False(t, fr.Exists(_DlockRedisKey+":a"))
+	assert.False(t, fr.Exists(_DlockRedisKey+":b"))
+
+	ml, err = dl.LockMany(context.Background(), "b", "c")
+	assert.Nil(t, err)
+	fr.FastForward(time.Millisecond * _DefaultRedisLockExpire)
+	assert.NotNil(t, ml.Unlock(context.Background()))
+
+	// 部分锁已被持有时, 一把锁都不会获取
+	ml, err = dl.LockMany(context.Background(), "b")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	before := fr.CommandCount()
+	_, err = dl.LockMany(ctx, "a", "b")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	// 两次尝试之间有退避, 不会空转
+	assert.Less(t, fr.CommandCount()-before, 30)
+	assert.Nil(t, ml.Unlock(context.Background()))
+}
+
+func TestRedisContextErr(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	// 服务端返回的错误在ctx到期后仍然原样返回
+	replyErr := redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	assert.Equal(t, replyErr, redisContextErr(ctx, replyErr))
+	assert.False(t, isContextErr(redisContextErr(ctx, replyErr)))
+
+	// 网络超时包装为ctx的错误, 并保留原始错误
+	netErr := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	err := redisContextErr(ctx, netErr)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, isContextErr(err))
+	assert.Contains(t, err.Error(), netErr.Error())
+
+	assert.Equal(t, netErr, redisContextErr(context.Background(), netErr))
+	assert.Nil(t, redisContextErr(ctx, nil))
+}
+
+func TestRedisHashSlot(t *testing.T) {
+	assert.Equal(t, uint16(12182), redisHashSlot("foo"))
+	assert.Equal(t, redisHashSlot("bar"), redisHashSlot("{bar}:1"))
+	assert.Equal(t, redisHashSlot("{bar}:1"), redisHashSlot("{bar}:2"))
+}
+
+func BenchmarkDlockByRedis(b *testing.B) {
+	fr := newFakeRedis(b)
+	conn := EstablishRedisConn(fr.connPoolConfig())
+	defer conn.Close()
+
+	pid := fmt.Sprintf("%d", goid.Get())
+	dl := NewDlockByRedis(conn)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		token, acquired := dl.TryLock(pid, 30000, 2)
+		if !acquired {
+			b.Fatal("failed to acquire lock")
+		}
+		dl.Unlock(pid, token)
+	}
+}
+
+func BenchmarkDlockByRedisContended(b *testing.B) {
+	fr := newFakeRedis(b)
+	conn := EstablishRedisConn(fr.connPoolConfig())
+	defer conn.Close()
+
+	dl := NewDlockByRedis(conn)
+
+	before := fr.CommandCount()
+	b.SetParallelism(4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		pid := fmt.Sprintf("%d", goid.Get())
+		for pb.Next() {
+			token, acquired := dl.TryLock(pid, 30000, 10)
+			if !acquired {
+				b.Error("failed to acquire lock")
+				return
+			}
+			// 持有锁一段时间, 其他goroutine在此期间竞争
+			time.Sleep(time.Millisecond)
+			dl.Unlock(pid, token)
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(fr.CommandCount()-before)/float64(b.N), "cmds/op")
+}
@@ -1,141 +1,449 @@
 package dlock
 
 import (
-	"strconv"
+	"context"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-zookeeper/zk"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	_ZKNodeReapInterval = time.Second
+)
+
 // DlockByZookeeper 通过zookeeper实现的分布式锁服务
 type DlockByZookeeper struct {
-	conn *zk.Conn
+	conn    ZKConn
+	acl     []zk.ACL
+	root    string
+	reaper  *zkNodeReaper
+	session *zkSessionWatcher
+
+	namespace        string
+	revocable        bool
+	containerSupport int32
+	dirReapInterval  time.Duration
+	dirReapMinAge    time.Duration
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+
+	events      *ZKSessionEvents
+	gracePeriod time.Duration
+	reestablish bool
+}
+
+// DlockByZookeeperOption DlockByZookeeper的可选配置.
+type DlockByZookeeperOption func(*DlockByZookeeper)
+
+// WithZKACL 设置创建锁目录及锁节点时使用的ACL, 默认为zk.WorldACL(zk.PermAll),
+// 可使用ZKCreatorAllACL, ZKDigestACL及ZKWorldReadableACL构造.
+func WithZKACL(acl []zk.ACL) DlockByZookeeperOption {
+	return func(dlz *DlockByZookeeper) {
+		dlz.acl = acl
+	}
+}
+
+// WithZKRootPath 设置锁服务的根路径 (含chroot), 默认与EstablishZKConn建立连接时的根路径一致.
+func WithZKRootPath(root string) DlockByZookeeperOption {
+	return func(dlz *DlockByZookeeper) {
+		dlz.root = strings.TrimRight(root, "/")
+	}
+}
+
+// WithZKNamespace 将所有锁节点放在根路径下的namespace之下 (如app1或team/app1), 用于隔离共享同一根路径的应用.
+func WithZKNamespace(namespace string) DlockByZookeeperOption {
+	return func(dlz *DlockByZookeeper) {
+		dlz.namespace = strings.Trim(namespace, "/")
+	}
+}
+
+// WithZKSessionEvents 监听会话事件, 会话失效时将所有已获取的锁标记为丢失,
+// 断开连接时将其标记为可疑, 并通过Handle返回的句柄通知持有者.
+func WithZKSessionEvents(events *ZKSessionEvents) DlockByZookeeperOption {
+	return func(dlz *DlockByZookeeper) {
+		dlz.events = events
+	}
+}
+
+// WithZKSuspectGracePeriod 设置断开连接后锁被视为丢失前的宽限期, 默认为5秒, 应小于会话超时.
+func WithZKSuspectGracePeriod(gracePeriod time.Duration) DlockByZookeeperOption {
+	return func(dlz *DlockByZookeeper) {
+		if gracePeriod > 0 {
+			dlz.gracePeriod = gracePeriod
+		}
+	}
+}
+
+// WithZKSessionReestablish 会话失效后继续使用客户端自动建立的新会话, 缺失的排队目录在获取锁时重建.
+// 默认会话失效后TryLock不再获取锁, 需要调用方重新建立连接.
+func WithZKSessionReestablish() DlockByZookeeperOption {
+	return func(dlz *DlockByZookeeper) {
+		dlz.reestablish = true
+	}
 }
 
 // NewDlockByZookeeper 获取DlockByZookeeper实例.
-func NewDlockByZookeeper(conn *zk.Conn) *DlockByZookeeper {
-	return &DlockByZookeeper{
-		conn: conn,
+func NewDlockByZookeeper(conn ZKConn, opts ...DlockByZookeeperOption) *DlockByZookeeper {
+	inst := newDlockByZookeeper(conn, opts...)
+	if inst.dirReapInterval > 0 {
+		go inst.runDirReaper()
+	}
+	if inst.events != nil || inst.revocable {
+		inst.session = newZKSessionWatcher(inst.reaper, inst.events, inst.gracePeriod, inst.reestablish)
+	}
+	return inst
+}
+
+// newDlockByZookeeper 获取仅应用了opts, 未监听会话事件的DlockByZookeeper实例,
+// 供其他基于zookeeper的同步原语共享节点相关的配置.
+func newDlockByZookeeper(conn ZKConn, opts ...DlockByZookeeperOption) *DlockByZookeeper {
+	inst := &DlockByZookeeper{
+		conn:        conn,
+		reaper:      newZKNodeReaper(conn),
+		gracePeriod: _DefaultZKSuspectGracePeriod,
+		closeCh:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	if inst.root == "" {
+		inst.root = zkRootPath(conn)
+	}
+	if inst.namespace != "" {
+		inst.root += "/" + inst.namespace
+	}
+	return inst
+}
+
+// fastLockPath 返回TryLock使用的排队目录.
+func (dlz *DlockByZookeeper) fastLockPath() string {
+	return dlz.root + "/" + _DlockFastLockDir
+}
+
+// lockDir 返回名为name的锁对应的目录, name可以是a/b/c形式的多级名称.
+// TryLock使用的排队目录是保留名称, 不能用作其他锁的目录.
+func (dlz *DlockByZookeeper) lockDir(name string) (string, error) {
+	if validZKRelativePath(name) != nil {
+		return "", ErrInvalidLockName
 	}
+	if name == _DlockFastLockDir || strings.HasPrefix(name, _DlockFastLockDir+"/") {
+		return "", ErrInvalidLockName
+	}
+	return dlz.root + "/" + name, nil
+}
+
+// Close 停止监听会话事件及后台清理, 不关闭连接.
+func (dlz *DlockByZookeeper) Close() {
+	dlz.closeOnce.Do(func() {
+		close(dlz.closeCh)
+		if dlz.session != nil {
+			dlz.session.close()
+		}
+	})
+}
+
+// Handle 返回token对应的锁句柄, 未启用WithZKSessionEvents及WithZKRevocable, 或锁已释放/丢失时返回nil.
+func (dlz *DlockByZookeeper) Handle(token string) *ZKLockHandle {
+	if dlz.session == nil {
+		return nil
+	}
+	return dlz.session.handle(token)
 }
 
 // TryLock 尝试获取分布式锁, 超时后就放弃 (不可重入锁).
 /*
 
 ==> acquire lock
-n = create("/dlock/fast-lock/request-", "", ephemeral|sequence)
+n = create("<root>/fast-lock/request-<guid>-", "", ephemeral|sequence)
 RETRY:
-    children = getChildren("/dlock/fast-lock", watch=False)
+    children = getChildren("<root>/fast-lock", watch=False)
     if n is lowest znode in children:
         return
     else:
-        exist("/dlock/fast-lock/request-" % (n - 1), watch=True)
+        exist("<root>/fast-lock/request-" % (n - 1), watch=True)
 
 watch_event:
 	goto RETRY
 
 */
 func (dlz *DlockByZookeeper) TryLock(pid string, timeout int64 /* in secs */) (token string, acquired bool) {
-	path, err := zkSafeCreateWithDefaultDataFilled(dlz.conn, _DlockFastLockPathPrefix, zk.FlagEphemeral|zk.FlagSequence)
+	ctx, cancel := zkTimeoutContext(timeout)
+	defer cancel()
+	return dlz.TryLockContext(ctx, pid)
+}
+
+// TryLockContext 尝试获取分布式锁, ctx被取消或超时后就放弃 (不可重入锁).
+func (dlz *DlockByZookeeper) TryLockContext(ctx context.Context, pid string) (token string, acquired bool) {
+	if dlz.session != nil {
+		if err := dlz.session.available(); err != nil {
+			log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
+			return
+		}
+	}
+	path, err := dlz.acquire(ctx, pid, dlz.fastLockPath())
 	if err != nil {
-		log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
 		acquired = false
 		return
 	}
-	seq := dlz.getSequenceNum(path, _DlockFastLockPathPrefix)
+	if dlz.session != nil {
+		h, err := dlz.session.hold(path)
+		if err != nil {
+			log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
+			dlz.reaper.abandon(pid, path)
+			return
+		}
+		if dlz.revocable {
+			go dlz.watchRevocation(path, h)
+		}
+	}
 
-	ticker1 := time.NewTicker(time.Duration(timeout) * time.Second)
-	defer ticker1.Stop()
-	ticker2 := time.NewTicker(time.Duration(200) * time.Millisecond)
-	defer ticker2.Stop()
-LOOP:
-	for {
-		select {
-		case <-ticker1.C:
-			{
-				log.WithField("pid", pid).Warn("timeout to acquire lock")
-				acquired = false
-				return
-			}
-		default:
-			{
-			TRY_AGAIN:
-				children, _, err := zkSafeGetChildren(dlz.conn, _DlockFastLockPath, false)
-				if err != nil {
-					log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
-					acquired = false
-					return
-				}
+	token = path
+	acquired = true
+	return
+}
 
-				minSeq := seq
-				prevSeq := -1
-				prevSeqPath := ""
-				for _, child := range children {
-					_seq := dlz.getSequenceNum(child, _DlockFastLockPathShortestPrefix)
-					if _seq < minSeq {
-						minSeq = _seq
-					}
-					if _seq < seq && _seq > prevSeq {
-						prevSeq = _seq
-						prevSeqPath = child
-					}
-				}
-				if seq == minSeq {
-					break LOOP
-				}
+// LockMany 一次性获取names对应的所有分布式锁, 要么全部获取, 要么一把都不获取, ctx被取消或超时后就放弃.
+// 所有锁按锁名排序后依次获取以避免死锁, 任意一把锁获取失败时释放已获取的锁.
+// 每把锁对应<root>/<name>下的一个排队目录, name可以是a/b/c形式的多级名称, 目录不存在时逐级创建,
+// 服务端支持时创建为容器节点, 不再使用后由服务端自动回收.
+func (dlz *DlockByZookeeper) LockMany(ctx context.Context, names ...string) (*MultiLock, error) {
+	names, err := normalizeLockNames(names)
+	if err != nil {
+		return nil, err
+	}
 
-				_, _, watcher, err := dlz.conn.ExistsW(_DlockFastLockPath + "/" + prevSeqPath)
-				if err != nil {
-					log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
-					acquired = false
-					return
-				}
+	dirs := make([]string, 0, len(names))
+	for _, name := range names {
+		dir, err := dlz.lockDir(name)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
 
-				ticker2.Reset(time.Duration(200) * time.Millisecond)
-				for {
-					select {
-					case ev, ok := <-watcher:
-						{
-							if !ok {
-								acquired = false
-								return
-							}
-							if ev.Type == zk.EventNodeDeleted {
-								goto TRY_AGAIN
-							}
-						}
-					case <-ticker2.C:
-						{
-							goto TRY_AGAIN
-						}
-					}
+	paths := make([]string, 0, len(names))
+	release := func(ctx context.Context) error {
+		var firstErr error
+		for i := len(paths) - 1; i >= 0; i-- {
+			if err := zkSafeDelete(ctx, dlz.conn, paths[i], -1); err != nil {
+				log.WithField("locks", names).WithError(err).Error("failed to release lock")
+				if firstErr == nil {
+					firstErr = err
 				}
 			}
 		}
+		return firstErr
+	}
+	for _, dir := range dirs {
+		path, err := dlz.acquire(ctx, "", dir)
+		if err != nil {
+			// ctx可能已经超时, 释放已获取的锁不受其限制
+			_ = release(context.Background())
+			return nil, err
+		}
+		paths = append(paths, path)
 	}
 
-	token = path
-	acquired = true
-	return
+	return &MultiLock{
+		names:  names,
+		unlock: release,
+	}, nil
+}
+
+// acquire 在dir下排队获取分布式锁, 返回代表锁的znode路径.
+// 只在前一个节点上设置监听, 监听触发后才重新获取子节点列表, 每一步之前都检查ctx.
+// 排队节点创建之后的任何失败都会删除该节点, 避免其成为阻塞其他等待者的"幽灵"持有者.
+func (dlz *DlockByZookeeper) acquire(ctx context.Context, pid, dir string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		log.WithField("pid", pid).Warn("timeout to acquire lock")
+		return "", err
+	}
+	path, err := dlz.createQueueNode(ctx, dir, _DlockFastLockPathShortestPrefix, nil)
+	if err != nil {
+		log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
+		return "", err
+	}
+
+	if err = dlz.wait(ctx, pid, dir, path); err != nil {
+		dlz.reaper.abandon(pid, path)
+		return "", err
+	}
+	return path, nil
+}
+
+// wait 等待path成为dir下序号最小的节点.
+func (dlz *DlockByZookeeper) wait(ctx context.Context, pid, dir, path string) error {
+	seq := dlz.getSequenceNum(path, dir+"/"+_DlockFastLockPathShortestPrefix)
+	return zkWaitPredecessor(ctx, dlz.conn, pid, dir, func(children []string) string {
+		return dlz.findPredecessor(children, seq)
+	})
+}
+
+// findPredecessor 返回序号小于seq的节点中序号最大的节点, 不存在时返回空字符串.
+func (dlz *DlockByZookeeper) findPredecessor(children []string, seq int) string {
+	prevSeq := -1
+	prevSeqPath := ""
+	for _, child := range children {
+		// 跳过多级锁名对应的子目录
+		if !strings.HasPrefix(child, _DlockFastLockPathShortestPrefix) {
+			continue
+		}
+		_seq := dlz.getSequenceNum(child, _DlockFastLockPathShortestPrefix)
+		if _seq < seq && _seq > prevSeq {
+			prevSeq = _seq
+			prevSeqPath = child
+		}
+	}
+	return prevSeqPath
 }
 
 // Unlock 释放分布式锁.
 /*
 
 ==> release lock (voluntarily or session timeout)
-delete("/dlock/fast-lock/request-" % n)
+delete("<root>/fast-lock/request-" % n)
 
 */
 func (dlz *DlockByZookeeper) Unlock(pid, token string) {
-	if err := zkSafeDelete(dlz.conn, token, -1); err != nil {
+	if dlz.session != nil {
+		dlz.session.release(token)
+	}
+	if err := zkSafeDelete(context.Background(), dlz.conn, token, -1); err != nil {
 		log.WithField("pid", pid).WithError(err).Error("failed to release lock")
 	}
 }
 
+// getSequenceNum 解析节点的序号, 受保护节点的前缀与序号之间还有guid.
 func (dlz *DlockByZookeeper) getSequenceNum(path, prefix string) int {
-	numStr := strings.TrimPrefix(path, prefix)
-	num, _ := strconv.Atoi(numStr)
-	return num
+	return zkSequenceNum(strings.TrimPrefix(path, prefix))
+}
+
+// zkWaitPredecessor 循环等待, 直到predecessor在dir的子节点中找不到需要等待的前序节点.
+// 只在前序节点上设置监听, 监听触发后才重新获取子节点列表, 每一步之前都检查ctx.
+func zkWaitPredecessor(ctx context.Context, conn ZKConn, pid, dir string, predecessor func(children []string) string) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			log.WithField("pid", pid).Warn("timeout to acquire lock")
+			return err
+		}
+		children, _, err := zkSafeGetChildren(ctx, conn, dir, false)
+		if err != nil {
+			log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
+			return err
+		}
+		prevSeqPath := predecessor(children)
+		if prevSeqPath == "" {
+			return nil
+		}
+
+		if err = ctx.Err(); err != nil {
+			log.WithField("pid", pid).Warn("timeout to acquire lock")
+			return err
+		}
+		exists, watcher, err := zkSafeExists(ctx, conn, dir+"/"+prevSeqPath, true)
+		if err != nil {
+			log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
+			return err
+		}
+		if !exists {
+			// 前序节点在获取子节点列表之后已被删除
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			{
+				log.WithField("pid", pid).Warn("timeout to acquire lock")
+				return ctx.Err()
+			}
+		case ev, ok := <-watcher:
+			{
+				if !ok {
+					return zk.ErrClosing
+				}
+				if ev.Err != nil {
+					log.WithField("pid", pid).WithError(ev.Err).Error("failed to acquire lock")
+					return ev.Err
+				}
+			}
+		}
+	}
+}
+
+// zkNodeReaper 在后台删除客户端已放弃的排队节点, 直到删除成功或节点随会话一同消失.
+// 仅在有待删除的节点时运行后台goroutine.
+type zkNodeReaper struct {
+	conn ZKConn
+
+	mu      sync.Mutex
+	paths   map[string]struct{}
+	running bool
+}
+
+func newZKNodeReaper(conn ZKConn) *zkNodeReaper {
+	return &zkNodeReaper{
+		conn:  conn,
+		paths: make(map[string]struct{}),
+	}
+}
+
+// abandon 删除加锁失败后遗留的排队节点, 删除失败时交给后台清理.
+func (r *zkNodeReaper) abandon(pid, path string) {
+	if err := zkSafeDelete(context.Background(), r.conn, path, -1); err != nil && err != zk.ErrNoNode {
+		log.WithField("pid", pid).WithError(err).Warnf("failed to delete abandoned znode <%s>, retry in background", path)
+		r.add(path)
+	}
+}
+
+func (r *zkNodeReaper) add(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paths[path] = struct{}{}
+	if !r.running {
+		r.running = true
+		go r.run()
+	}
+}
+
+func (r *zkNodeReaper) run() {
+	ticker := time.NewTicker(_ZKNodeReapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mu.Lock()
+		paths := make([]string, 0, len(r.paths))
+		for path := range r.paths {
+			paths = append(paths, path)
+		}
+		r.mu.Unlock()
+
+		for _, path := range paths {
+			err := r.conn.Delete(path, -1)
+			switch err {
+			// 删除成功, 或者节点已随会话一同消失, 或者连接已被关闭
+			case nil, zk.ErrNoNode, zk.ErrSessionExpired, zk.ErrClosing:
+				{
+					r.mu.Lock()
+					delete(r.paths, path)
+					r.mu.Unlock()
+				}
+			default:
+				{
+					log.WithError(err).Debugf("failed to delete abandoned znode <%s>", path)
+				}
+			}
+		}
+
+		r.mu.Lock()
+		if len(r.paths) == 0 {
+			r.running = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+	}
 }
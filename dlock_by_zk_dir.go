@@ -0,0 +1,238 @@
+package dlock
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// zookeeper的CreateMode.CONTAINER, go-zookeeper中对应的常量名为FlagTTL
+	_ZKFlagContainer = zk.FlagTTL
+
+	_ZKContainerUnknown     = 0
+	_ZKContainerSupported   = 1
+	_ZKContainerUnsupported = 2
+
+	// 写入锁目录的数据, 空目录清理只删除带有该标记的节点, 不会误删队列元素, 计数器等保存数据的持久节点
+	_ZKLockDirMarker = "__DLOCK_DIR__"
+)
+
+// WithZKEmptyDirReaper 服务端不支持容器节点 (3.5以下) 时, 每隔interval删除一次创建时间超过minAge的空锁目录.
+// 服务端支持容器节点时, 空的锁目录由服务端自动回收, 后台清理不做任何事情.
+func WithZKEmptyDirReaper(interval, minAge time.Duration) DlockByZookeeperOption {
+	return func(dlz *DlockByZookeeper) {
+		dlz.dirReapInterval = interval
+		dlz.dirReapMinAge = minAge
+	}
+}
+
+// createLockDir 逐级创建锁目录, 根路径以下的节点优先创建为容器节点,
+// 容器节点的最后一个子节点被删除后, 由服务端自动回收. 根路径以下的节点写入目录标记.
+func (dlz *DlockByZookeeper) createLockDir(ctx context.Context, dir string) error {
+	if !strings.HasPrefix(dir, dlz.root+"/") {
+		return zkCreateAll(ctx, dlz.conn, dir, dlz.acl)
+	}
+	if err := zkCreateAll(ctx, dlz.conn, dlz.root, dlz.acl); err != nil {
+		return err
+	}
+	path := dlz.root
+	for _, seg := range strings.Split(strings.TrimPrefix(dir, dlz.root+"/"), "/") {
+		path += "/" + seg
+		if err := dlz.createContainer(ctx, path); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// createContainer 创建带目录标记的容器节点, 服务端不支持时退化为持久节点.
+func (dlz *DlockByZookeeper) createContainer(ctx context.Context, path string) error {
+	if atomic.LoadInt32(&dlz.containerSupport) != _ZKContainerUnsupported {
+		var retry bool
+		err := zkRetry(ctx, dlz.conn, func() error {
+			_, err := dlz.conn.CreateContainer(path, []byte(_ZKLockDirMarker), _ZKFlagContainer, zkACLOrDefault(dlz.acl))
+			// 因为网络问题导致的假失败
+			if err == zk.ErrNodeExists && retry {
+				return nil
+			}
+			retry = retry || IsZKRetryableError(err)
+			return err
+		})
+		if !isZKUnimplemented(err) {
+			if err == nil || err == zk.ErrNodeExists {
+				atomic.StoreInt32(&dlz.containerSupport, _ZKContainerSupported)
+			}
+			return err
+		}
+		log.Info("zookeeper server does not support container nodes, fall back to persistent nodes")
+		atomic.StoreInt32(&dlz.containerSupport, _ZKContainerUnsupported)
+	}
+	_, err := zkSafeCreate(ctx, dlz.conn, path, []byte(_ZKLockDirMarker), 0, dlz.acl)
+	return err
+}
+
+// createQueueNode 在dir下创建受保护的临时顺序节点, dir不存在 (如首次使用, 或空目录已被回收) 时创建后重试,
+// 直到ctx被取消或超时. data为nil时填充默认数据.
+func (dlz *DlockByZookeeper) createQueueNode(ctx context.Context, dir, prefix string, data []byte) (string, error) {
+	for {
+		path, err := zkSafeCreateProtected(ctx, dlz.conn, dir, prefix, data, dlz.acl)
+		if err != zk.ErrNoNode {
+			return path, err
+		}
+		// 目录在创建后又被回收, 与空目录清理交替发生时持续重试
+		if err = ctx.Err(); err != nil {
+			return "", err
+		}
+		if err = dlz.createLockDir(ctx, dir); err != nil {
+			return "", err
+		}
+	}
+}
+
+// ReapEmptyLockDirs 删除根路径下创建时间超过minAge的空锁目录, 返回删除的目录数.
+// 只删除createLockDir创建 (带有目录标记) 的节点, 保存数据的持久节点 (如队列元素) 及旧版本创建的目录不会被删除.
+// 服务端拒绝删除非空目录, 因此不会影响正在使用的锁; 排队节点创建时如果目录恰好被删除,
+// 获取锁的一方会重新创建目录并重试, 直到ctx被取消或超时.
+func (dlz *DlockByZookeeper) ReapEmptyLockDirs(minAge time.Duration) (int, error) {
+	ctx := context.Background()
+	children, _, err := zkSafeGetChildren(ctx, dlz.conn, dlz.root, false)
+	if err == zk.ErrNoNode {
+		// 尚未创建过任何锁目录
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	reaped := 0
+	for _, child := range children {
+		if child == _DlockFastLockDir {
+			continue
+		}
+		n, _, err := dlz.reapEmptyDir(ctx, dlz.root+"/"+child, minAge)
+		reaped += n
+		if err != nil {
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
+
+// reapEmptyDir 自底向上删除path下的空目录, 返回删除的目录数及path本身是否已被删除.
+func (dlz *DlockByZookeeper) reapEmptyDir(ctx context.Context, path string, minAge time.Duration) (int, bool, error) {
+	children, stat, err := dlz.children(ctx, path)
+	if err == zk.ErrNoNode {
+		return 0, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	// 锁节点等临时节点不是目录
+	if stat.EphemeralOwner != 0 {
+		return 0, false, nil
+	}
+
+	reaped := 0
+	remaining := len(children)
+	for _, child := range children {
+		n, deleted, err := dlz.reapEmptyDir(ctx, path+"/"+child, minAge)
+		reaped += n
+		if err != nil {
+			return reaped, false, err
+		}
+		if deleted {
+			remaining--
+		}
+	}
+	if remaining > 0 {
+		return reaped, false, nil
+	}
+
+	// 子节点删除后重新检查目录标记, 子节点数及创建时间. 与获取锁一方的竞争由服务端拒绝删除非空目录 (ErrNotEmpty),
+	// 以及createQueueNode在目录被删除后重新创建并重试保证
+	var data []byte
+	err = zkRetry(ctx, dlz.conn, func() error {
+		var err error
+		data, stat, err = dlz.conn.Get(path)
+		return err
+	})
+	if err == zk.ErrNoNode {
+		return reaped, true, nil
+	}
+	if err != nil {
+		return reaped, false, err
+	}
+	if string(data) != _ZKLockDirMarker || stat.NumChildren > 0 || time.Since(time.UnixMilli(stat.Ctime)) < minAge {
+		return reaped, false, nil
+	}
+	// 重试后节点不存在, 说明之前的删除请求已经成功
+	err = zkRetry(ctx, dlz.conn, func() error {
+		return dlz.conn.Delete(path, stat.Version)
+	})
+	switch err {
+	case nil:
+		{
+			return reaped + 1, true, nil
+		}
+	case zk.ErrNoNode:
+		{
+			return reaped, true, nil
+		}
+	// 目录正在被使用
+	case zk.ErrNotEmpty, zk.ErrBadVersion:
+		{
+			return reaped, false, nil
+		}
+	default:
+		{
+			return reaped, false, err
+		}
+	}
+}
+
+// children 获取path的子节点及节点状态.
+func (dlz *DlockByZookeeper) children(ctx context.Context, path string) ([]string, *zk.Stat, error) {
+	var children []string
+	var stat *zk.Stat
+	err := zkRetry(ctx, dlz.conn, func() error {
+		var err error
+		children, stat, err = dlz.conn.Children(path)
+		return err
+	})
+	return children, stat, err
+}
+
+// runDirReaper 服务端不支持容器节点时定期删除空的锁目录, Close后退出.
+func (dlz *DlockByZookeeper) runDirReaper() {
+	ticker := time.NewTicker(dlz.dirReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dlz.closeCh:
+			{
+				return
+			}
+		case <-ticker.C:
+			{
+				if atomic.LoadInt32(&dlz.containerSupport) == _ZKContainerSupported {
+					continue
+				}
+				if n, err := dlz.ReapEmptyLockDirs(dlz.dirReapMinAge); err != nil {
+					log.WithError(err).Warn("failed to reap empty lock dirs")
+				} else if n > 0 {
+					log.Debugf("reaped %d empty lock dirs", n)
+				}
+			}
+		}
+	}
+}
+
+// isZKUnimplemented 服务端是否不支持该操作, go-zookeeper没有为UNIMPLEMENTED (-6) 定义错误值.
+func isZKUnimplemented(err error) bool {
+	return isZKErrCode(err, _ZKErrUnimplemented)
+}
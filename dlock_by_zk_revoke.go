@@ -0,0 +1,173 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// 写入持有者锁节点的撤销标记, 与Curator的Revoker一致
+	_ZKRevokeMarker = "__REVOKE__"
+)
+
+var (
+	// ErrNoLockHolder 锁当前没有持有者.
+	ErrNoLockHolder = errors.New("no lock holder")
+)
+
+// WithZKRevocable 获取锁后监听锁节点的数据, 收到撤销请求时通过Handle返回的锁句柄的OnRevoke回调通知持有者.
+// 未启用WithZKSessionEvents时锁句柄只反映撤销, 不反映会话状态的变化.
+func WithZKRevocable() DlockByZookeeperOption {
+	return func(dlz *DlockByZookeeper) {
+		dlz.revocable = true
+	}
+}
+
+// Revoke 请求TryLock锁当前的持有者释放锁, 向持有者的锁节点写入撤销标记, 持有者通过OnRevoke回调收到请求后自行释放.
+// forceAfter大于0时阻塞等待, 持有者在forceAfter内没有释放锁则强制删除其锁节点, 持有者的锁句柄随之标记为丢失;
+// 否则写入撤销标记后立即返回.
+/*
+
+==> revoke
+children = getChildren("<root>/fast-lock", watch=False)
+n = lowest znode in children
+set(n, "__REVOKE__")
+if forceAfter > 0:
+    exist(n, watch=True)
+    if n still exists after forceAfter:
+        delete(n)
+
+*/
+func (dlz *DlockByZookeeper) Revoke(ctx context.Context, forceAfter time.Duration) error {
+	dir := dlz.fastLockPath()
+	children, _, err := zkSafeGetChildren(ctx, dlz.conn, dir, false)
+	if err != nil {
+		log.WithError(err).Error("failed to revoke lock")
+		return err
+	}
+	holder := dlz.findHolder(children)
+	if holder == "" {
+		return ErrNoLockHolder
+	}
+	path := dir + "/" + holder
+
+	err = zkRetry(ctx, dlz.conn, func() error {
+		_, err := dlz.conn.Set(path, []byte(_ZKRevokeMarker), -1)
+		return err
+	})
+	if err == zk.ErrNoNode {
+		// 持有者已经释放了锁
+		return nil
+	}
+	if err != nil {
+		log.WithError(err).Errorf("failed to revoke lock <%s>", path)
+		return err
+	}
+	if forceAfter <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(forceAfter)
+	defer timer.Stop()
+	for {
+		exists, watcher, err := zkSafeExists(ctx, dlz.conn, path, true)
+		if err != nil {
+			log.WithError(err).Errorf("failed to revoke lock <%s>", path)
+			return err
+		}
+		if !exists {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			{
+				return ctx.Err()
+			}
+		case <-timer.C:
+			{
+				log.Warnf("lock <%s> not released in %v, revoke it forcibly", path, forceAfter)
+				if err = zkSafeDelete(ctx, dlz.conn, path, -1); err != nil && err != zk.ErrNoNode {
+					log.WithError(err).Errorf("failed to revoke lock <%s>", path)
+					return err
+				}
+				return nil
+			}
+		case ev, ok := <-watcher:
+			{
+				if !ok {
+					return zk.ErrClosing
+				}
+				if ev.Err != nil {
+					log.WithError(ev.Err).Errorf("failed to revoke lock <%s>", path)
+					return ev.Err
+				}
+			}
+		}
+	}
+}
+
+// findHolder 返回序号最小的排队节点, 即锁的持有者, 不存在时返回空字符串.
+func (dlz *DlockByZookeeper) findHolder(children []string) string {
+	lowestSeq := -1
+	lowestSeqPath := ""
+	for _, child := range children {
+		if !strings.HasPrefix(child, _DlockFastLockPathShortestPrefix) {
+			continue
+		}
+		_seq := dlz.getSequenceNum(child, _DlockFastLockPathShortestPrefix)
+		if _seq >= 0 && (lowestSeq < 0 || _seq < lowestSeq) {
+			lowestSeq = _seq
+			lowestSeqPath = child
+		}
+	}
+	return lowestSeqPath
+}
+
+// watchRevocation 监听锁节点的数据, 收到撤销标记时通知持有者, 锁节点被强制删除时将锁标记为丢失.
+// 锁被释放或丢失后退出.
+func (dlz *DlockByZookeeper) watchRevocation(token string, h *ZKLockHandle) {
+	for {
+		var data []byte
+		var watcher <-chan zk.Event
+		err := zkRetry(context.Background(), dlz.conn, func() error {
+			var err error
+			data, _, watcher, err = dlz.conn.GetW(token)
+			return err
+		})
+		if err == zk.ErrNoNode {
+			// 锁已被释放, 或者被强制撤销
+			if dlz.session.handle(token) == h {
+				log.Warnf("lock <%s> revoked forcibly", token)
+				dlz.session.drop(token)
+			}
+			return
+		}
+		if err != nil {
+			// 会话相关的错误由zkSessionWatcher处理
+			log.WithError(err).Debugf("stop watching revocation of lock <%s>", token)
+			return
+		}
+		if string(data) == _ZKRevokeMarker {
+			h.revoke()
+		}
+
+		select {
+		case <-h.Lost():
+			{
+				return
+			}
+		case ev, ok := <-watcher:
+			{
+				if !ok || ev.Err != nil {
+					return
+				}
+			}
+		}
+	}
+}
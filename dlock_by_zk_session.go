@@ -0,0 +1,319 @@
+package dlock
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	_DefaultZKSuspectGracePeriod = time.Second * 5
+)
+
+var (
+	// ErrLockLost 锁已丢失 (会话失效, 断开连接超过宽限期, 或被强制撤销).
+	ErrLockLost = errors.New("lock lost")
+)
+
+// ZKLockState 基于zookeeper的锁的持有状态.
+type ZKLockState int32
+
+const (
+	// ZKLockHeld 锁被正常持有.
+	ZKLockHeld ZKLockState = iota
+	// ZKLockSuspect 与zookeeper断开连接, 会话可能已经失效, 持有者应暂停对共享资源的修改.
+	ZKLockSuspect
+	// ZKLockLost 锁已丢失, 不可恢复.
+	ZKLockLost
+)
+
+func (s ZKLockState) String() string {
+	switch s {
+	case ZKLockHeld:
+		return "held"
+	case ZKLockSuspect:
+		return "suspect"
+	case ZKLockLost:
+		return "lost"
+	default:
+		return "unknown"
+	}
+}
+
+// ZKLockHandle 一把已获取的锁的句柄, 用于感知会话状态变化导致的锁状态变化.
+type ZKLockHandle struct {
+	token   string
+	lostCh  chan struct{}
+	changes chan ZKLockState
+
+	mu       sync.Mutex
+	state    ZKLockState
+	revoked  bool
+	onRevoke []func(*ZKLockHandle)
+}
+
+func newZKLockHandle(token string) *ZKLockHandle {
+	return &ZKLockHandle{
+		token:   token,
+		lostCh:  make(chan struct{}),
+		changes: make(chan ZKLockState, 1),
+		state:   ZKLockHeld,
+	}
+}
+
+// Token 返回锁对应的token.
+func (h *ZKLockHandle) Token() string {
+	return h.token
+}
+
+// State 返回锁当前的状态.
+func (h *ZKLockHandle) State() ZKLockState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// Err 锁已丢失时返回ErrLockLost, 否则返回nil.
+func (h *ZKLockHandle) Err() error {
+	if h.State() == ZKLockLost {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// Lost 返回锁丢失时被关闭的通道.
+func (h *ZKLockHandle) Lost() <-chan struct{} {
+	return h.lostCh
+}
+
+// Changes 返回锁状态变化的通知, 只保留最新的一次, 消费不及时时旧的通知会被丢弃.
+func (h *ZKLockHandle) Changes() <-chan ZKLockState {
+	return h.changes
+}
+
+// OnRevoke 注册收到撤销请求时的回调, 回调在单独的goroutine中执行, 持有者应尽快调用Unlock释放锁.
+// 注册时已经收到撤销请求的立即执行回调. 需启用WithZKRevocable.
+func (h *ZKLockHandle) OnRevoke(fn func(*ZKLockHandle)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onRevoke = append(h.onRevoke, fn)
+	if h.revoked {
+		go fn(h)
+	}
+}
+
+// RevokeRequested 是否已收到撤销请求.
+func (h *ZKLockHandle) RevokeRequested() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.revoked
+}
+
+// revoke 收到撤销请求, 只通知一次.
+func (h *ZKLockHandle) revoke() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.revoked || h.state == ZKLockLost {
+		return
+	}
+	h.revoked = true
+	for _, fn := range h.onRevoke {
+		go fn(h)
+	}
+}
+
+// setState 更新锁的状态, 已丢失的锁不会再恢复.
+func (h *ZKLockHandle) setState(state ZKLockState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == state || h.state == ZKLockLost {
+		return
+	}
+	h.state = state
+	if state == ZKLockLost {
+		close(h.lostCh)
+	}
+	select {
+	case <-h.changes:
+	default:
+	}
+	h.changes <- state
+}
+
+// zkSessionWatcher 监听会话事件, 维护所有已获取的锁的状态.
+/*
+
+StateDisconnected  ==> held locks become suspect, lost after the grace period
+StateHasSession    ==> suspect locks become held again
+StateExpired       ==> all locks are lost
+
+*/
+type zkSessionWatcher struct {
+	reaper      *zkNodeReaper
+	gracePeriod time.Duration
+	reestablish bool
+	unsubscribe func()
+
+	mu      sync.Mutex
+	handles map[string]*ZKLockHandle
+	timer   *time.Timer
+	expired bool
+}
+
+// newZKSessionWatcher events为nil时只登记锁句柄 (用于撤销通知), 不跟踪会话状态.
+func newZKSessionWatcher(reaper *zkNodeReaper, events *ZKSessionEvents, gracePeriod time.Duration, reestablish bool) *zkSessionWatcher {
+	w := &zkSessionWatcher{
+		reaper:      reaper,
+		gracePeriod: gracePeriod,
+		reestablish: reestablish,
+		unsubscribe: func() {},
+		handles:     make(map[string]*ZKLockHandle),
+	}
+	if events != nil {
+		var evCh <-chan zk.Event
+		evCh, w.unsubscribe = events.Subscribe()
+		go w.run(evCh)
+	}
+	return w
+}
+
+// hold 登记一把已获取的锁, 会话已失效且不重建会话时返回ErrSessionExpired.
+func (w *zkSessionWatcher) hold(token string) (*ZKLockHandle, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.expired {
+		return nil, zk.ErrSessionExpired
+	}
+	h := newZKLockHandle(token)
+	if w.timer != nil {
+		h.setState(ZKLockSuspect)
+	}
+	w.handles[token] = h
+	return h, nil
+}
+
+// available 获取锁之前检查会话是否可用.
+func (w *zkSessionWatcher) available() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.expired {
+		return zk.ErrSessionExpired
+	}
+	return nil
+}
+
+func (w *zkSessionWatcher) handle(token string) *ZKLockHandle {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.handles[token]
+}
+
+func (w *zkSessionWatcher) release(token string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.handles, token)
+}
+
+// drop 锁节点已被删除 (如被强制撤销), 将锁标记为丢失.
+func (w *zkSessionWatcher) drop(token string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if h, ok := w.handles[token]; ok {
+		h.setState(ZKLockLost)
+		delete(w.handles, token)
+	}
+}
+
+func (w *zkSessionWatcher) close() {
+	w.unsubscribe()
+}
+
+func (w *zkSessionWatcher) run(evCh <-chan zk.Event) {
+	for ev := range evCh {
+		switch ev.State {
+		case zk.StateDisconnected:
+			{
+				w.suspect()
+			}
+		case zk.StateHasSession:
+			{
+				w.recover()
+			}
+		case zk.StateExpired:
+			{
+				log.Warn("zookeeper session expired, all locks are lost")
+				w.lose(true)
+			}
+		}
+	}
+	// 连接已关闭
+	w.lose(false)
+}
+
+func (w *zkSessionWatcher) suspect() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		return
+	}
+	for _, h := range w.handles {
+		h.setState(ZKLockSuspect)
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(w.gracePeriod, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		// 宽限期内已经恢复连接
+		if w.timer != timer {
+			return
+		}
+		log.Warnf("disconnected from zookeeper for more than %v, all locks are lost", w.gracePeriod)
+		w.loseLocked(false)
+	})
+	w.timer = timer
+}
+
+func (w *zkSessionWatcher) recover() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	for _, h := range w.handles {
+		h.setState(ZKLockHeld)
+	}
+	if w.expired && w.reestablish {
+		// 新的会话已经建立, 锁服务依赖的节点由ZKClient重建, 缺失的排队目录在获取锁时重建
+		w.expired = false
+	}
+}
+
+// lose 将所有已获取的锁标记为丢失.
+func (w *zkSessionWatcher) lose(expired bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.loseLocked(expired)
+}
+
+// loseLocked 同lose, 调用方需持有w.mu.
+func (w *zkSessionWatcher) loseLocked(expired bool) {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	for token, h := range w.handles {
+		h.setState(ZKLockLost)
+		delete(w.handles, token)
+		if !expired {
+			// 会话可能仍然有效, 删除锁节点以免阻塞其他等待者
+			w.reaper.add(token)
+		}
+	}
+	if expired {
+		w.expired = true
+	}
+}
@@ -1,8 +1,11 @@
 package dlock
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -16,6 +19,242 @@ var (
 	fakeZKEndpoints = []string{"127.0.0.1:2181", "127.0.0.1:2182", "127.0.0.1:2183"}
 )
 
+// fakeZKConn 内存中的zookeeper替身, 模拟不支持容器节点的服务端 (3.5以下), watch与服务端一样只触发一次.
+type fakeZKConn struct {
+	mu            sync.Mutex
+	nodes         map[string]*fakeZKNode
+	zxid          int64
+	childrenCalls int
+	nodeWatches   map[string][]chan zk.Event
+	childWatches  map[string][]chan zk.Event
+	beforeCreate  func(path string) // 创建节点前在调用方的goroutine中执行
+	afterDelete   func(path string) // 删除节点后在调用方的goroutine中执行
+}
+
+type fakeZKNode struct {
+	data []byte
+	stat zk.Stat
+}
+
+func newFakeZKConn() *fakeZKConn {
+	return &fakeZKConn{
+		nodes:        map[string]*fakeZKNode{"/": {}},
+		nodeWatches:  make(map[string][]chan zk.Event),
+		childWatches: make(map[string][]chan zk.Event),
+	}
+}
+
+// watch 在path上注册watch, 调用方需持有c.mu.
+func (c *fakeZKConn) watch(watches map[string][]chan zk.Event, path string) <-chan zk.Event {
+	ch := make(chan zk.Event, 1)
+	watches[path] = append(watches[path], ch)
+	return ch
+}
+
+// fire 触发path上的watch, 调用方需持有c.mu.
+func (c *fakeZKConn) fire(watches map[string][]chan zk.Event, path string, typ zk.EventType) {
+	for _, ch := range watches[path] {
+		ch <- zk.Event{Type: typ, State: zk.StateHasSession, Path: path}
+	}
+	delete(watches, path)
+}
+
+func fakeZKParent(path string) string {
+	if idx := strings.LastIndex(path, "/"); idx > 0 {
+		return path[:idx]
+	}
+	return "/"
+}
+
+func (c *fakeZKConn) Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	c.mu.Lock()
+	hook := c.beforeCreate
+	c.mu.Unlock()
+	if hook != nil {
+		hook(path)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	parent, ok := c.nodes[fakeZKParent(path)]
+	if !ok {
+		return "", zk.ErrNoNode
+	}
+	if flags&zk.FlagSequence != 0 {
+		path = fmt.Sprintf("%s%010d", path, parent.stat.Cversion)
+	}
+	if _, ok = c.nodes[path]; ok {
+		return "", zk.ErrNodeExists
+	}
+	c.zxid++
+	node := &fakeZKNode{data: data}
+	node.stat.Czxid = c.zxid
+	node.stat.Ctime = time.Now().UnixMilli()
+	if flags&zk.FlagEphemeral != 0 {
+		node.stat.EphemeralOwner = 1
+	}
+	c.nodes[path] = node
+	parent.stat.Cversion++
+	parent.stat.NumChildren++
+	c.fire(c.nodeWatches, path, zk.EventNodeCreated)
+	c.fire(c.childWatches, fakeZKParent(path), zk.EventNodeChildrenChanged)
+	return path, nil
+}
+
+func (c *fakeZKConn) CreateContainer(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	return "", fmt.Errorf("unknown error: %d", _ZKErrUnimplemented)
+}
+
+func (c *fakeZKConn) Get(path string) ([]byte, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node, ok := c.nodes[path]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	stat := node.stat
+	return node.data, &stat, nil
+}
+
+func (c *fakeZKConn) GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	data, stat, err := c.Get(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return data, stat, c.watch(c.nodeWatches, path), nil
+}
+
+func (c *fakeZKConn) Set(path string, data []byte, version int32) (*zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node, ok := c.nodes[path]
+	if !ok {
+		return nil, zk.ErrNoNode
+	}
+	if version != -1 && version != node.stat.Version {
+		return nil, zk.ErrBadVersion
+	}
+	node.data = data
+	node.stat.Version++
+	c.fire(c.nodeWatches, path, zk.EventNodeDataChanged)
+	stat := node.stat
+	return &stat, nil
+}
+
+func (c *fakeZKConn) Exists(path string) (bool, *zk.Stat, error) {
+	_, stat, err := c.Get(path)
+	if err == zk.ErrNoNode {
+		return false, &zk.Stat{}, nil
+	}
+	return err == nil, stat, err
+}
+
+func (c *fakeZKConn) ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stat := &zk.Stat{}
+	node, ok := c.nodes[path]
+	if ok {
+		*stat = node.stat
+	}
+	return ok, stat, c.watch(c.nodeWatches, path), nil
+}
+
+func (c *fakeZKConn) Children(path string) ([]string, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.childrenCalls++
+	node, ok := c.nodes[path]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	children := make([]string, 0, node.stat.NumChildren)
+	for p := range c.nodes {
+		if p != "/" && fakeZKParent(p) == path {
+			children = append(children, p[strings.LastIndex(p, "/")+1:])
+		}
+	}
+	stat := node.stat
+	return children, &stat, nil
+}
+
+func (c *fakeZKConn) ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	children, stat, err := c.Children(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return children, stat, c.watch(c.childWatches, path), nil
+}
+
+func (c *fakeZKConn) Delete(path string, version int32) error {
+	c.mu.Lock()
+	err := c.delete(path, version)
+	hook := c.afterDelete
+	c.mu.Unlock()
+	if err == nil && hook != nil {
+		hook(path)
+	}
+	return err
+}
+
+// delete 删除节点, 调用方需持有c.mu.
+func (c *fakeZKConn) delete(path string, version int32) error {
+	node, ok := c.nodes[path]
+	if !ok {
+		return zk.ErrNoNode
+	}
+	if version != -1 && version != node.stat.Version {
+		return zk.ErrBadVersion
+	}
+	if node.stat.NumChildren > 0 {
+		return zk.ErrNotEmpty
+	}
+	delete(c.nodes, path)
+	c.nodes[fakeZKParent(path)].stat.NumChildren--
+	c.fire(c.nodeWatches, path, zk.EventNodeDeleted)
+	c.fire(c.childWatches, path, zk.EventNodeDeleted)
+	c.fire(c.childWatches, fakeZKParent(path), zk.EventNodeChildrenChanged)
+	return nil
+}
+
+func (c *fakeZKConn) setBeforeCreate(hook func(path string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.beforeCreate = hook
+}
+
+func (c *fakeZKConn) setAfterDelete(hook func(path string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.afterDelete = hook
+}
+
+// expireSessions 模拟所有会话失效, 删除全部临时节点.
+func (c *fakeZKConn) expireSessions() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, node := range c.nodes {
+		if node.stat.EphemeralOwner != 0 {
+			_ = c.delete(path, -1)
+		}
+	}
+}
+
+func (c *fakeZKConn) exists(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.nodes[path]
+	return ok
+}
+
 func TestDlockByZookeeper(t *testing.T) {
 	SkipAutoTest(t)
 
@@ -51,3 +290,1015 @@ func TestDlockByZookeeper(t *testing.T) {
 
 	assert.Equal(t, 20, total)
 }
+
+func TestDlockByZookeeperLockMany(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	defer CloseZKConn(conn)
+
+	dl := NewDlockByZookeeper(conn)
+	ml, err := dl.LockMany(context.Background(), "account-b", "account-a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"account-a", "account-b"}, ml.Names())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = dl.LockMany(ctx, "account-c", "account-b")
+	assert.NotNil(t, err)
+	// 超时放弃的排队节点已被删除
+	children, _, err := conn.Children(_DlockRootPath + "/account-b")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(children))
+
+	assert.Nil(t, ml.Unlock(context.Background()))
+	ml, err = dl.LockMany(context.Background(), "account-c", "account-b")
+	assert.Nil(t, err)
+	assert.Nil(t, ml.Unlock(context.Background()))
+}
+
+func TestRWLockByZookeeper(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	defer CloseZKConn(conn)
+
+	rw, err := NewRWLockByZookeeper(conn, "config")
+	assert.Nil(t, err)
+
+	// 读锁之间共享
+	rtoken1, acquired := rw.TryRLock("r1", 1)
+	assert.True(t, acquired)
+	rtoken2, acquired := rw.TryRLock("r2", 1)
+	assert.True(t, acquired)
+
+	// 写锁需要等待所有在前的读锁释放
+	_, acquired = rw.TryLock("w1", 1)
+	assert.False(t, acquired)
+	rw.Unlock("r1", rtoken1)
+	rw.Unlock("r2", rtoken2)
+	wtoken, acquired := rw.TryLock("w1", 1)
+	assert.True(t, acquired)
+
+	// 读锁需要等待在前的写锁释放
+	_, acquired = rw.TryRLock("r1", 1)
+	assert.False(t, acquired)
+	rw.Unlock("w1", wtoken)
+	rtoken1, acquired = rw.TryRLock("r1", 1)
+	assert.True(t, acquired)
+	rw.Unlock("r1", rtoken1)
+}
+
+func TestZKSequenceNum(t *testing.T) {
+	assert.Equal(t, 12, zkSequenceNum("/dlock/config/read-0000000012"))
+	assert.Equal(t, 13, zkSequenceNum("write-0000000013"))
+	assert.Equal(t, -1, zkSequenceNum("write-"))
+}
+
+func TestSemaphoreByZookeeper(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	defer CloseZKConn(conn)
+
+	sem, err := NewSemaphoreByZookeeper(conn, "workers", 2)
+	assert.Nil(t, err)
+
+	lease1, acquired := sem.TryAcquire("p1", 1)
+	assert.True(t, acquired)
+	lease2, acquired := sem.TryAcquire("p2", 1)
+	assert.True(t, acquired)
+	_, acquired = sem.TryAcquire("p3", 1)
+	assert.False(t, acquired)
+
+	// 归还租约后, 等待者被子节点监听唤醒
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		sem.Release("p1", lease1)
+	}()
+	lease3, acquired := sem.TryAcquire("p3", 2)
+	assert.True(t, acquired)
+	sem.Release("p2", lease2)
+	sem.Release("p3", lease3)
+
+	_, err = NewSemaphoreByZookeeper(conn, "workers", 0)
+	assert.Equal(t, ErrInvalidMaxLeases, err)
+}
+
+func TestLeaderElectorByZookeeper(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	defer CloseZKConn(conn)
+
+	e1, err := NewLeaderElectorByZookeeper(conn, "scheduler", "node-1")
+	assert.Nil(t, err)
+	e2, err := NewLeaderElectorByZookeeper(conn, "scheduler", "node-2")
+	assert.Nil(t, err)
+
+	assert.Nil(t, e1.Campaign(context.Background()))
+	assert.True(t, e1.IsLeader())
+	assert.True(t, <-e1.Changes())
+	leader, err := e1.Leader()
+	assert.Nil(t, err)
+	assert.Equal(t, "node-1", leader)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NotNil(t, e2.Campaign(ctx))
+	assert.False(t, e2.IsLeader())
+
+	// leader退出后, 等待中的候选者当选
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		assert.Nil(t, e1.Resign())
+	}()
+	assert.Nil(t, e2.Campaign(context.Background()))
+	assert.False(t, <-e1.Changes())
+	assert.False(t, e1.IsLeader())
+	leader, err = e2.Leader()
+	assert.Nil(t, err)
+	assert.Equal(t, "node-2", leader)
+	assert.Nil(t, e2.Resign())
+}
+
+func TestLeaderElectorByZookeeperCampaignUnlocked(t *testing.T) {
+	conn := newFakeZKConn()
+	e, err := NewLeaderElectorByZookeeper(conn, "scheduler", "node-1")
+	assert.Nil(t, err)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	conn.setBeforeCreate(func(path string) {
+		if strings.Contains(path, _LeaderElectorCandidatePrefix) {
+			once.Do(func() {
+				close(entered)
+				<-release
+			})
+		}
+	})
+	result := make(chan error, 1)
+	go func() {
+		result <- e.Campaign(context.Background())
+	}()
+	<-entered
+
+	// 创建候选节点期间不持有锁, IsLeader不会被阻塞
+	isLeader := make(chan bool, 1)
+	go func() {
+		isLeader <- e.IsLeader()
+	}()
+	select {
+	case leader := <-isLeader:
+		assert.False(t, leader)
+	case <-time.After(time.Second):
+		t.Fatal("IsLeader blocked while campaigning")
+	}
+	assert.Equal(t, ErrAlreadyCampaigning, e.Campaign(context.Background()))
+
+	// 此时Resign中止竞选, 已创建的候选节点被删除
+	assert.Nil(t, e.Resign())
+	close(release)
+	assert.True(t, errors.Is(<-result, context.Canceled))
+	assert.Eventually(t, func() bool {
+		children, _, err := conn.Children(e.dir)
+		return err == nil && len(children) == 0
+	}, time.Second, time.Millisecond*10)
+
+	assert.Nil(t, e.Campaign(context.Background()))
+	assert.True(t, e.IsLeader())
+	assert.Nil(t, e.Resign())
+}
+
+func TestDoubleBarrierByZookeeper(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	defer CloseZKConn(conn)
+
+	// 参与者未到齐时无法进入
+	b, err := NewDoubleBarrierByZookeeper(conn, "batch", 3)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.Enter(ctx))
+	assert.Equal(t, ErrNotEntered, b.Leave(context.Background()))
+
+	var entered, left int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b, err := NewDoubleBarrierByZookeeper(conn, "batch", 3)
+			assert.Nil(t, err)
+
+			time.Sleep(time.Millisecond * time.Duration(100*i))
+			assert.Nil(t, b.Enter(context.Background()))
+			mu.Lock()
+			entered++
+			// 所有参与者都已进入后才能离开屏障
+			assert.Equal(t, 0, left)
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond * time.Duration(100*i))
+			assert.Nil(t, b.Leave(context.Background()))
+			mu.Lock()
+			left++
+			assert.Equal(t, 3, entered)
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 3, left)
+
+	// 所有参与者离开后ready节点被删除, 屏障可以再次使用
+	exists, _, err := conn.Exists(b.dir + "/" + _DoubleBarrierReadyNode)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	_, err = NewDoubleBarrierByZookeeper(conn, "batch", 0)
+	assert.Equal(t, ErrInvalidParticipants, err)
+}
+
+func TestDoubleBarrierByZookeeperTwoRounds(t *testing.T) {
+	conn := newFakeZKConn()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	b1, err := NewDoubleBarrierByZookeeper(conn, "batch", 2)
+	assert.Nil(t, err)
+	b2, err := NewDoubleBarrierByZookeeper(conn, "batch", 2)
+	assert.Nil(t, err)
+	run := func(fn func(b *DoubleBarrierByZookeeper) error, barriers ...*DoubleBarrierByZookeeper) {
+		var wg sync.WaitGroup
+		for _, b := range barriers {
+			wg.Add(1)
+			go func(b *DoubleBarrierByZookeeper) {
+				defer wg.Done()
+				assert.Nil(t, fn(b))
+			}(b)
+		}
+		wg.Wait()
+	}
+	enter := func(b *DoubleBarrierByZookeeper) error { return b.Enter(ctx) }
+	leave := func(b *DoubleBarrierByZookeeper) error { return b.Leave(ctx) }
+	run(enter, b1, b2)
+	first, second := b1, b2
+	if zkSequenceNum(b1.path) > zkSequenceNum(b2.path) {
+		first, second = b2, b1
+	}
+
+	// second删除自己的节点后, 重新获取子节点之前, first离开并进入下一轮
+	left := make(chan error, 1)
+	go func() {
+		left <- first.Leave(ctx)
+	}()
+	entered := make(chan error, 1)
+	secondPath := second.path
+	conn.setAfterDelete(func(path string) {
+		if path != secondPath {
+			return
+		}
+		assert.Nil(t, <-left)
+		go func() {
+			entered <- first.Enter(ctx)
+		}()
+		assert.Eventually(t, func() bool {
+			children, _, _ := conn.Children(first.dir)
+			return len(children) == 1 && strings.HasPrefix(children[0], _DoubleBarrierParticipantPrefix)
+		}, time.Second, time.Millisecond*10)
+	})
+
+	// second不等待下一轮的参与者, 随后进入下一轮
+	assert.Nil(t, second.Leave(ctx))
+	conn.setAfterDelete(nil)
+	assert.Nil(t, second.Enter(ctx))
+	assert.Nil(t, <-entered)
+	run(leave, b1, b2)
+	children, _, err := conn.Children(b1.dir)
+	assert.Nil(t, err)
+	assert.Empty(t, children)
+}
+
+func TestDoubleBarrierByZookeeperSessionsExpired(t *testing.T) {
+	conn := newFakeZKConn()
+	barriers := make([]*DoubleBarrierByZookeeper, 3)
+	for i := range barriers {
+		b, err := NewDoubleBarrierByZookeeper(conn, "batch", 2)
+		assert.Nil(t, err)
+		barriers[i] = b
+	}
+	var wg sync.WaitGroup
+	for _, b := range barriers[:2] {
+		wg.Add(1)
+		go func(b *DoubleBarrierByZookeeper) {
+			defer wg.Done()
+			assert.Nil(t, b.Enter(context.Background()))
+		}(b)
+	}
+	wg.Wait()
+
+	// 所有参与者会话失效, 遗留的ready节点不会让下一轮的参与者提前通过
+	conn.expireSessions()
+	assert.True(t, conn.exists(barriers[0].dir+"/"+_DoubleBarrierReadyNode))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, barriers[2].Enter(ctx))
+	assert.False(t, conn.exists(barriers[0].dir+"/"+_DoubleBarrierReadyNode))
+
+	// 参与者到齐后正常通过
+	entered := make(chan error, 1)
+	go func() {
+		b, _ := NewDoubleBarrierByZookeeper(conn, "batch", 2)
+		entered <- b.Enter(context.Background())
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, barriers[2].Enter(ctx))
+	assert.Nil(t, <-entered)
+}
+
+func TestQueueByZookeeper(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	defer CloseZKConn(conn)
+
+	q1, err := NewQueueByZookeeper(conn, "tasks")
+	assert.Nil(t, err)
+	q2, err := NewQueueByZookeeper(conn, "tasks")
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	_, err = q1.Put(ctx, []byte("task-1"))
+	assert.Nil(t, err)
+	_, err = q1.Put(ctx, []byte("task-2"))
+	assert.Nil(t, err)
+
+	// 按入队顺序认领, 已认领的元素不会被其他消费者认领
+	item1, err := q1.Take(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "task-1", string(item1.Data))
+	item2, err := q2.Take(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "task-2", string(item2.Data))
+	assert.Equal(t, ErrItemNotClaimed, q2.Ack(ctx, item1.ID))
+	assert.Nil(t, q1.Ack(ctx, item1.ID))
+	assert.Nil(t, q2.Ack(ctx, item2.ID))
+
+	// 队列为空时阻塞, 直到有新的元素
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer cancel()
+	_, err = q1.Take(timeoutCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		_, err := q2.Put(ctx, []byte("task-3"))
+		assert.Nil(t, err)
+	}()
+	item3, err := q1.Take(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "task-3", string(item3.Data))
+
+	// 消费者会话失效后, 未确认的元素重新回到队列中
+	conn2, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	q3, err := NewQueueByZookeeper(conn2, "tasks")
+	assert.Nil(t, err)
+	_, err = q3.Put(ctx, []byte("task-4"))
+	assert.Nil(t, err)
+	item4, err := q3.Take(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "task-4", string(item4.Data))
+	CloseZKConn(conn2)
+	item4, err = q2.Take(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "task-4", string(item4.Data))
+	assert.Nil(t, q2.Ack(ctx, item4.ID))
+	assert.Nil(t, q1.Ack(ctx, item3.ID))
+}
+
+func TestDistributedCounterByZookeeper(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	defer CloseZKConn(conn)
+
+	ctx := context.Background()
+	c, err := NewDistributedCounterByZookeeper(conn, fmt.Sprintf("ids-%d", time.Now().UnixNano()))
+	assert.Nil(t, err)
+	value, err := c.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), value)
+
+	value, err = c.Add(ctx, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), value)
+	swapped, err := c.CompareAndSet(ctx, 9, 100)
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+	swapped, err = c.CompareAndSet(ctx, 10, 100)
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+
+	// 并发分配的ID不重复
+	var mu sync.Mutex
+	ids := make(map[int64]struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				id, err := c.Increment(ctx)
+				assert.Nil(t, err)
+				mu.Lock()
+				ids[id] = struct{}{}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 100, len(ids))
+	value, err = c.Get(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), value)
+}
+
+func TestDlockByZookeeperWaitPredecessor(t *testing.T) {
+	conn := newFakeZKConn()
+	dl := NewDlockByZookeeper(conn)
+	holder, acquired := dl.TryLock("p1", 1)
+	assert.True(t, acquired)
+
+	// 锁被持有期间, 等待方只在前序节点上监听, 监听未触发时不重新获取子节点, 到期后返回
+	conn.mu.Lock()
+	calls := conn.childrenCalls
+	conn.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	start := time.Now()
+	_, acquired = dl.TryLockContext(ctx, "p2")
+	assert.False(t, acquired)
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, time.Millisecond*200)
+	assert.Less(t, elapsed, time.Millisecond*400)
+	conn.mu.Lock()
+	assert.Equal(t, 1, conn.childrenCalls-calls)
+	conn.mu.Unlock()
+
+	// 锁被释放后等待方立即获取锁
+	result := make(chan bool, 1)
+	go func() {
+		_, acquired := dl.TryLock("p2", 1)
+		result <- acquired
+	}()
+	time.Sleep(time.Millisecond * 50)
+	dl.Unlock("p1", holder)
+	select {
+	case acquired = <-result:
+		assert.True(t, acquired)
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("waiter not woken after the lock was released")
+	}
+}
+
+func TestZKSessionWatcher(t *testing.T) {
+	evCh := make(chan zk.Event)
+	defer close(evCh)
+
+	w := newZKSessionWatcher(nil, NewZKSessionEvents(evCh), time.Minute, false)
+	h, err := w.hold("/dlock/fast-lock/request-0000000001")
+	assert.Nil(t, err)
+	assert.Equal(t, ZKLockHeld, h.State())
+
+	// 断开连接后锁变为可疑, 宽限期内恢复会话后锁恢复正常
+	evCh <- zk.Event{Type: zk.EventSession, State: zk.StateDisconnected}
+	assert.Equal(t, ZKLockSuspect, <-h.Changes())
+	evCh <- zk.Event{Type: zk.EventSession, State: zk.StateHasSession}
+	assert.Equal(t, ZKLockHeld, <-h.Changes())
+	assert.Nil(t, h.Err())
+
+	// 会话失效后锁丢失, 且不再登记新的锁
+	evCh <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+	select {
+	case <-h.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock not lost")
+	}
+	assert.Equal(t, ErrLockLost, h.Err())
+	assert.Nil(t, w.handle(h.Token()))
+	_, err = w.hold("/dlock/fast-lock/request-0000000002")
+	assert.Equal(t, zk.ErrSessionExpired, err)
+}
+
+func TestZKSessionEventsSlowSubscriber(t *testing.T) {
+	evCh := make(chan zk.Event)
+	defer close(evCh)
+
+	events := NewZKSessionEvents(evCh)
+	slow, unsubscribeSlow := events.Subscribe()
+	fast, unsubscribeFast := events.Subscribe()
+	defer unsubscribeFast()
+
+	// 不读取事件的订阅者不阻塞其他订阅者, 缓冲区写满后丢弃最旧的事件
+	for i := 0; i < _ZKSessionEventsBufferSize*2; i++ {
+		evCh <- zk.Event{Type: zk.EventSession, State: zk.StateDisconnected}
+		assert.Equal(t, zk.StateDisconnected, (<-fast).State)
+	}
+	evCh <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+	assert.Equal(t, zk.StateExpired, (<-fast).State)
+
+	var last zk.Event
+	for i := 0; i < _ZKSessionEventsBufferSize; i++ {
+		last = <-slow
+	}
+	assert.Equal(t, zk.StateExpired, last.State)
+
+	// 取消订阅不会因事件分发而死锁
+	done := make(chan struct{})
+	go func() {
+		unsubscribeSlow()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("unsubscribe blocked")
+	}
+	_, ok := <-slow
+	assert.False(t, ok)
+}
+
+func TestZKLockHandleRevoke(t *testing.T) {
+	h := newZKLockHandle("/dlock/fast-lock/request-0000000001")
+	assert.False(t, h.RevokeRequested())
+
+	revoked := make(chan string, 2)
+	h.OnRevoke(func(h *ZKLockHandle) {
+		revoked <- h.Token()
+	})
+	// 撤销请求只通知一次
+	h.revoke()
+	h.revoke()
+	assert.True(t, h.RevokeRequested())
+	assert.Equal(t, h.Token(), <-revoked)
+
+	// 收到撤销请求后注册的回调立即执行
+	h.OnRevoke(func(h *ZKLockHandle) {
+		revoked <- h.Token()
+	})
+	assert.Equal(t, h.Token(), <-revoked)
+
+	dl := newDlockByZookeeper(nil)
+	assert.Equal(t, "request-b-0000000002", dl.findHolder([]string{"request-a-0000000003", "request-b-0000000002", "jobs"}))
+	assert.Equal(t, "", dl.findHolder([]string{"jobs"}))
+}
+
+func TestDlockByZookeeperRevoke(t *testing.T) {
+	SkipAutoTest(t)
+
+	client, err := NewZKClient(fakeZKEndpoints, 0)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	dl := NewDlockByZookeeper(client, WithZKSessionEvents(client.Events()), WithZKRevocable())
+	defer dl.Close()
+
+	// 持有者收到撤销请求后自行释放
+	token, acquired := dl.TryLock("holder", 1)
+	assert.True(t, acquired)
+	dl.Handle(token).OnRevoke(func(h *ZKLockHandle) {
+		dl.Unlock("holder", h.Token())
+	})
+	assert.Nil(t, dl.Revoke(context.Background(), 0))
+	_, acquired = dl.TryLock("requester", 2)
+	assert.True(t, acquired)
+	assert.Nil(t, dl.Revoke(context.Background(), time.Millisecond*200))
+
+	// 持有者不释放时强制撤销
+	token, acquired = dl.TryLock("holder", 2)
+	assert.True(t, acquired)
+	h := dl.Handle(token)
+	assert.Nil(t, dl.Revoke(context.Background(), time.Millisecond*200))
+	select {
+	case <-h.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock not revoked")
+	}
+	assert.True(t, h.RevokeRequested())
+	assert.Equal(t, ErrLockLost, h.Err())
+	assert.Equal(t, ErrNoLockHolder, dl.Revoke(context.Background(), 0))
+}
+
+func TestDlockByZookeeperRevokeWithoutSessionEvents(t *testing.T) {
+	conn := newFakeZKConn()
+	dl := NewDlockByZookeeper(conn, WithZKRevocable())
+	defer dl.Close()
+
+	// 未监听会话事件时持有者同样收到撤销请求
+	token, acquired := dl.TryLock("holder", 1)
+	assert.True(t, acquired)
+	h := dl.Handle(token)
+	if !assert.NotNil(t, h) {
+		return
+	}
+	h.OnRevoke(func(h *ZKLockHandle) {
+		dl.Unlock("holder", h.Token())
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, dl.Revoke(ctx, time.Millisecond*500))
+	assert.True(t, h.RevokeRequested())
+	assert.False(t, conn.exists(token))
+	assert.Nil(t, dl.Handle(token))
+
+	// 持有者不释放时强制撤销
+	token, acquired = dl.TryLock("holder", 1)
+	assert.True(t, acquired)
+	h = dl.Handle(token)
+	assert.Nil(t, dl.Revoke(ctx, time.Millisecond*100))
+	select {
+	case <-h.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock not revoked")
+	}
+	assert.Equal(t, ErrLockLost, h.Err())
+}
+
+func TestZKACL(t *testing.T) {
+	acl := ZKWorldReadableACL(ZKDigestACL("user", "pass"))
+	assert.Equal(t, 2, len(acl))
+	assert.Equal(t, "digest", acl[0].Scheme)
+	assert.Equal(t, int32(zk.PermAll), acl[0].Perms)
+	assert.Equal(t, zk.WorldACL(zk.PermRead)[0], acl[1])
+	assert.Equal(t, zk.WorldACL(zk.PermAll), zkACLOrDefault(nil))
+}
+
+func TestDlockByZookeeperWithACL(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn(fakeZKEndpoints, 0, WithZKDigestAuth("user", "pass"))
+	defer CloseZKConn(conn)
+	other, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	defer CloseZKConn(other)
+
+	dl := NewDlockByZookeeper(conn, WithZKACL(ZKWorldReadableACL(ZKCreatorAllACL())))
+	ml, err := dl.LockMany(context.Background(), "acl-protected")
+	assert.Nil(t, err)
+	defer ml.Unlock(context.Background())
+
+	// 未认证的客户端可以读取, 但不能删除别人的锁节点
+	children, _, err := other.Children(_DlockRootPath + "/acl-protected")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(children))
+	_, err = other.Create(_DlockRootPath+"/acl-protected/x", nil, 0, zk.WorldACL(zk.PermAll))
+	assert.Equal(t, zk.ErrNoAuth, err)
+}
+
+func TestSplitZKChroot(t *testing.T) {
+	hosts, chroot, err := splitZKChroot([]string{"h1:2181", "h2:2181/app/"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"h1:2181", "h2:2181"}, hosts)
+	assert.Equal(t, "/app", chroot)
+
+	_, _, err = splitZKChroot([]string{"h1:2181/app1", "h2:2181/app2"})
+	assert.Equal(t, ErrInvalidZKPath, err)
+	_, _, err = splitZKChroot([]string{"h1:2181/app//x"})
+	assert.Equal(t, ErrInvalidZKPath, err)
+}
+
+func TestNewZKClientError(t *testing.T) {
+	// 连接失败时返回错误, 不退出进程
+	_, err := NewZKClient(nil, 0)
+	assert.NotNil(t, err)
+	_, err = NewZKClient([]string{"h1:2181/app1", "h2:2181/app2"}, 0)
+	assert.True(t, errors.Is(err, ErrInvalidZKPath))
+}
+
+func TestForwardZKEvents(t *testing.T) {
+	conn := &zk.Conn{}
+	in := make(chan zk.Event, 1)
+	zkConnInfos.Store(conn, &zkConnInfo{root: "/app"})
+	out := forwardZKEvents(conn, in)
+	assert.Equal(t, "/app", zkRootPath(conn))
+
+	in <- zk.Event{State: zk.StateDisconnected}
+	assert.Equal(t, zk.StateDisconnected, (<-out).State)
+	// 连接关闭 (事件通道被关闭) 后删除连接对应的配置
+	close(in)
+	_, ok := <-out
+	assert.False(t, ok)
+	assert.Equal(t, _DlockRootPath, zkRootPath(conn))
+}
+
+func TestDlockByZookeeperLockDir(t *testing.T) {
+	dl := newDlockByZookeeper(nil, WithZKRootPath("/app/dlock/"), WithZKNamespace("team/svc"))
+	assert.Equal(t, "/app/dlock/team/svc/fast-lock", dl.fastLockPath())
+	dir, err := dl.lockDir("orders/42")
+	assert.Nil(t, err)
+	assert.Equal(t, "/app/dlock/team/svc/orders/42", dir)
+	for _, name := range []string{"", "/orders", "orders/", "orders//42", "orders/../42", "fast-lock", "fast-lock/42"} {
+		_, err = dl.lockDir(name)
+		assert.Equal(t, ErrInvalidLockName, err, name)
+	}
+	_, err = dl.lockDir("fast-lock-2")
+	assert.Nil(t, err)
+
+	// LockMany不能与TryLock共用排队目录
+	conn := newFakeZKConn()
+	dl = NewDlockByZookeeper(conn)
+	token, acquired := dl.TryLock("p1", 1)
+	assert.True(t, acquired)
+	_, err = dl.LockMany(context.Background(), "fast-lock")
+	assert.Equal(t, ErrInvalidLockName, err)
+	dl.Unlock("p1", token)
+	assert.Equal(t, _DlockRootPath, newDlockByZookeeper(nil).root)
+}
+
+func TestDlockByZookeeperWithNamespace(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn([]string{"127.0.0.1:2181/chroot"}, 0)
+	defer CloseZKConn(conn)
+
+	dl1 := NewDlockByZookeeper(conn, WithZKNamespace("app1"))
+	dl2 := NewDlockByZookeeper(conn, WithZKNamespace("app2"))
+	token1, acquired := dl1.TryLock("p1", 1)
+	assert.True(t, acquired)
+	assert.True(t, strings.HasPrefix(token1, "/chroot/dlock/app1/fast-lock/"))
+	// 不同命名空间的锁互不影响
+	token2, acquired := dl2.TryLock("p2", 1)
+	assert.True(t, acquired)
+	dl1.Unlock("p1", token1)
+	dl2.Unlock("p2", token2)
+
+	// 多级锁名
+	ml, err := dl1.LockMany(context.Background(), "orders", "orders/42")
+	assert.Nil(t, err)
+	assert.Nil(t, ml.Unlock(context.Background()))
+}
+
+func TestDlockByZookeeperReapEmptyLockDirs(t *testing.T) {
+	SkipAutoTest(t)
+
+	conn, _ := EstablishZKConn(fakeZKEndpoints, 0)
+	defer CloseZKConn(conn)
+
+	dl := NewDlockByZookeeper(conn, WithZKNamespace("reap"))
+	ml, err := dl.LockMany(context.Background(), "jobs/1", "jobs/2")
+	assert.Nil(t, err)
+
+	// 正在使用的锁目录不会被删除
+	_, err = dl.ReapEmptyLockDirs(0)
+	assert.Nil(t, err)
+	exists, _, err := conn.Exists(dl.root + "/jobs/1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	assert.Nil(t, ml.Unlock(context.Background()))
+	_, err = dl.ReapEmptyLockDirs(0)
+	assert.Nil(t, err)
+	exists, _, err = conn.Exists(dl.root + "/jobs")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	// 目录被删除后可以重新获取锁
+	ml, err = dl.LockMany(context.Background(), "jobs/1")
+	assert.Nil(t, err)
+	assert.Nil(t, ml.Unlock(context.Background()))
+}
+
+func TestDlockByZookeeperReapWhileAcquiring(t *testing.T) {
+	conn := newFakeZKConn()
+	dl := NewDlockByZookeeper(conn)
+
+	// 每次创建排队节点之前空目录都被回收, 获取锁的一方持续重建目录并重试
+	reaped := 0
+	conn.setBeforeCreate(func(path string) {
+		if strings.HasPrefix(path, dl.root+"/jobs/") && reaped < 5 {
+			n, err := dl.ReapEmptyLockDirs(0)
+			assert.Nil(t, err)
+			reaped += n
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ml, err := dl.LockMany(ctx, "jobs")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, reaped)
+	assert.Nil(t, ml.Unlock(ctx))
+
+	// 目录持续被回收时, ctx到期后放弃
+	conn.setBeforeCreate(func(path string) {
+		if strings.HasPrefix(path, dl.root+"/jobs/") {
+			_, _ = dl.ReapEmptyLockDirs(0)
+		}
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = dl.LockMany(ctx, "jobs")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestQueueByZookeeperSurvivesDirReaper(t *testing.T) {
+	conn := newFakeZKConn()
+	q, err := NewQueueByZookeeper(conn, "tasks")
+	assert.Nil(t, err)
+	ctx := context.Background()
+	id, err := q.Put(ctx, []byte("task-1"))
+	assert.Nil(t, err)
+
+	// 待处理的元素是持久的叶子节点, 不是锁目录, 不会被空目录清理删除
+	dl := NewDlockByZookeeper(conn)
+	_, err = dl.ReapEmptyLockDirs(0)
+	assert.Nil(t, err)
+	assert.True(t, conn.exists(q.itemsDir+"/"+id))
+
+	// 空的认领目录被删除后可以重新认领
+	assert.False(t, conn.exists(q.claimsDir))
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer cancel()
+	item, err := q.Take(timeoutCtx)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "task-1", string(item.Data))
+	assert.Nil(t, q.Ack(ctx, item.ID))
+	n, err := dl.ReapEmptyLockDirs(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.False(t, conn.exists(dl.root+"/tasks"))
+}
+
+func TestQueueByZookeeperTakeReusesWatch(t *testing.T) {
+	conn := newFakeZKConn()
+	q, err := NewQueueByZookeeper(conn, "tasks")
+	assert.Nil(t, err)
+	watches := func(path string) int {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return len(conn.childWatches[path])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	result := make(chan *ZKQueueItem, 1)
+	go func() {
+		item, err := q.Take(ctx)
+		assert.Nil(t, err)
+		result <- item
+	}()
+	assert.Eventually(t, func() bool {
+		return watches(q.itemsDir) == 1 && watches(q.claimsDir) == 1
+	}, time.Second, time.Millisecond)
+
+	// 认领目录多次变化, 尚未触发的元素目录监听不会重复设置
+	for i := 0; i < 5; i++ {
+		_, err = conn.Create(q.claimsDir+"/x", nil, zk.FlagEphemeral, nil)
+		assert.Nil(t, err)
+		assert.Eventually(t, func() bool {
+			return watches(q.claimsDir) == 1
+		}, time.Second, time.Millisecond)
+		assert.Nil(t, conn.Delete(q.claimsDir+"/x", -1))
+		assert.Eventually(t, func() bool {
+			return watches(q.claimsDir) == 1
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, 1, watches(q.itemsDir))
+	}
+
+	_, err = q.Put(ctx, []byte("task-1"))
+	assert.Nil(t, err)
+	select {
+	case item := <-result:
+		if assert.NotNil(t, item) {
+			assert.Equal(t, "task-1", string(item.Data))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("take blocked after put")
+	}
+}
+
+func TestDistributedCounterByZookeeperSurvivesDirReaper(t *testing.T) {
+	conn := newFakeZKConn()
+	c, err := NewDistributedCounterByZookeeper(conn, "ids")
+	assert.Nil(t, err)
+	ctx := context.Background()
+	_, err = c.Add(ctx, 10)
+	assert.Nil(t, err)
+
+	// 空的锁目录被删除, 计数器节点保留, 重新获取的计数器不会从0开始分配重复的ID
+	dl := NewDlockByZookeeper(conn)
+	n, err := dl.ReapEmptyLockDirs(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, conn.exists(c.path))
+	c, err = NewDistributedCounterByZookeeper(conn, "ids")
+	assert.Nil(t, err)
+	value, err := c.Increment(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), value)
+}
+
+func TestIsZKUnimplemented(t *testing.T) {
+	assert.True(t, isZKUnimplemented(fmt.Errorf("unknown error: %v", -6)))
+	assert.False(t, isZKUnimplemented(zk.ErrNoNode))
+	assert.False(t, isZKUnimplemented(nil))
+}
+
+func TestZKRetryPolicy(t *testing.T) {
+	assert.True(t, IsZKRetryableError(zk.ErrConnectionClosed))
+	assert.True(t, IsZKRetryableError(zk.ErrNoServer))
+	assert.True(t, IsZKRetryableError(fmt.Errorf("unknown error: %v", -127)))
+	assert.False(t, IsZKRetryableError(zk.ErrSessionExpired))
+	assert.False(t, IsZKRetryableError(nil))
+
+	policy := ZKRetryPolicy{MaxRetries: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 4}
+	// 可重试的错误重试后成功
+	calls := 0
+	err := policy.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return zk.ErrConnectionClosed
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+
+	// 超出重试次数
+	calls = 0
+	err = policy.Do(context.Background(), func() error {
+		calls++
+		return zk.ErrNoServer
+	})
+	assert.Equal(t, zk.ErrNoServer, err)
+	assert.Equal(t, 4, calls)
+
+	// 不可重试的错误直接返回
+	calls = 0
+	err = policy.Do(context.Background(), func() error {
+		calls++
+		return zk.ErrNoNode
+	})
+	assert.Equal(t, zk.ErrNoNode, err)
+	assert.Equal(t, 1, calls)
+
+	// 超出总耗时
+	policy = ZKRetryPolicy{BaseBackoff: time.Millisecond * 20, MaxElapsedTime: time.Millisecond * 50}
+	calls = 0
+	err = policy.Do(context.Background(), func() error {
+		calls++
+		return zk.ErrConnectionClosed
+	})
+	assert.Equal(t, zk.ErrConnectionClosed, err)
+	assert.True(t, calls > 1 && calls < 5)
+
+	// ctx被取消后不再重试
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*30)
+	defer cancel()
+	policy = ZKRetryPolicy{BaseBackoff: time.Millisecond * 10}
+	err = policy.Do(ctx, func() error {
+		return zk.ErrConnectionClosed
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestZKProtectedNodeName(t *testing.T) {
+	guid := newZKGUID()
+	assert.Equal(t, 32, len(guid))
+	assert.NotEqual(t, guid, newZKGUID())
+
+	dl := newDlockByZookeeper(nil)
+	child := _DlockFastLockPathShortestPrefix + guid + "-0000000042"
+	assert.Equal(t, 42, dl.getSequenceNum(child, _DlockFastLockPathShortestPrefix))
+	assert.Equal(t, 42, dl.getSequenceNum("/dlock/fast-lock/"+child, "/dlock/fast-lock/"+_DlockFastLockPathShortestPrefix))
+	assert.Equal(t, child, dl.findPredecessor([]string{"orders", child, _DlockFastLockPathShortestPrefix + guid + "-0000000043"}, 43))
+}
+
+func TestZKClient(t *testing.T) {
+	SkipAutoTest(t)
+
+	client, err := NewZKClient(fakeZKEndpoints, 0, WithZKConnRootPath("/dlock-client"))
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, zk.StateHasSession, client.State())
+	assert.Equal(t, "/dlock-client", client.RootPath())
+
+	// 所有同步原语共享同一个客户端
+	dl := NewDlockByZookeeper(client, WithZKSessionEvents(client.Events()))
+	defer dl.Close()
+	token, acquired := dl.TryLock("p1", 1)
+	assert.True(t, acquired)
+	assert.True(t, strings.HasPrefix(token, "/dlock-client/fast-lock/"))
+	assert.Equal(t, ZKLockHeld, dl.Handle(token).State())
+	dl.Unlock("p1", token)
+
+	rw, err := NewRWLockByZookeeper(client, "config")
+	assert.Nil(t, err)
+	token, acquired = rw.TryLock("p1", 1)
+	assert.True(t, acquired)
+	rw.Unlock("p1", token)
+}
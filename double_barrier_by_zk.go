@@ -0,0 +1,344 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	_DoubleBarrierParticipantPrefix = "participant-"
+	_DoubleBarrierReadyNode         = "ready"
+)
+
+var (
+	// ErrInvalidParticipants 屏障的参与者数不合法.
+	ErrInvalidParticipants = errors.New("invalid participants")
+	// ErrAlreadyEntered 已经进入屏障.
+	ErrAlreadyEntered = errors.New("already entered")
+	// ErrNotEntered 尚未进入屏障.
+	ErrNotEntered = errors.New("not entered")
+	// ErrBarrierNodeLost 参与者节点已丢失 (会话失效).
+	ErrBarrierNodeLost = errors.New("barrier participant node lost")
+)
+
+// DoubleBarrierByZookeeper 通过zookeeper实现的双屏障, 参与者一起开始, 一起结束.
+// 每个参与者是<root>/<name>下的一个临时顺序节点, 参与者会话失效时节点自动删除, 不会被当作仍在屏障内;
+// 第participants个参与者进入时创建<root>/<name>/ready, 最后一个离开的参与者删除ready.
+// 早于参与者节点创建的ready节点属于之前的一轮 (如参与者全部会话失效而没有离开), 视为过期删除后重新等待.
+/*
+
+==> enter
+n = create("<root>/<name>/participant-", "", ephemeral|sequence)
+RETRY:
+    children = getChildren("<root>/<name>", watch=True)
+    if "ready" in children and "ready" is newer than n:
+        return
+    if "ready" in children:
+        delete("<root>/<name>/ready")
+        goto RETRY
+    if number of participant- znodes in children >= participants:
+        create("<root>/<name>/ready", "", persistent)
+        return
+
+==> leave
+RETRY:
+    children = participant- znodes in getChildren("<root>/<name>", watch=False)
+    if n not in children:
+        ignore znodes created after n was deleted (the next round)
+    if no children:
+        return
+    if n is the only znode in children:
+        delete(n), delete("<root>/<name>/ready")
+        return
+    if n is lowest znode in children:
+        exist(the highest znode in children, watch=True)
+    else:
+        delete(n)
+        exist(the lowest znode in children, watch=True)
+
+watch_event:
+	goto RETRY
+
+*/
+type DoubleBarrierByZookeeper struct {
+	conn         ZKConn
+	base         *DlockByZookeeper
+	dir          string
+	participants int
+	reaper       *zkNodeReaper
+
+	mu         sync.Mutex
+	path       string
+	readyCzxid int64
+}
+
+// NewDoubleBarrierByZookeeper 获取名为name的DoubleBarrierByZookeeper实例, 屏障目录不存在时自动创建.
+// 使用同一个屏障的所有参与者必须使用相同的participants, opts同NewDlockByZookeeper (会话事件相关的配置不生效).
+func NewDoubleBarrierByZookeeper(conn ZKConn, name string, participants int, opts ...DlockByZookeeperOption) (*DoubleBarrierByZookeeper, error) {
+	if participants <= 0 {
+		return nil, ErrInvalidParticipants
+	}
+	base := newDlockByZookeeper(conn, opts...)
+	dir, err := base.lockDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = base.createLockDir(context.Background(), dir); err != nil {
+		log.WithField("barrier", name).WithError(err).Error("failed to create double barrier")
+		return nil, err
+	}
+	return &DoubleBarrierByZookeeper{
+		conn:         conn,
+		base:         base,
+		dir:          dir,
+		participants: participants,
+		reaper:       base.reaper,
+	}, nil
+}
+
+// Enter 进入屏障, 阻塞直到participants个参与者都已进入, 或者ctx被取消或超时 (此时退出屏障).
+func (b *DoubleBarrierByZookeeper) Enter(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path != "" {
+		return ErrAlreadyEntered
+	}
+
+	path, err := b.base.createQueueNode(ctx, b.dir, _DoubleBarrierParticipantPrefix, nil)
+	if err != nil {
+		log.WithField("barrier", b.dir).WithError(err).Error("failed to enter double barrier")
+		return err
+	}
+	czxid, err := b.waitReady(ctx, path[len(b.dir)+1:])
+	if err != nil {
+		b.reaper.abandon("", path)
+		return err
+	}
+	b.path = path
+	b.readyCzxid = czxid
+	return nil
+}
+
+// Leave 离开屏障, 阻塞直到所有参与者都已离开, 或者ctx被取消或超时.
+// 无论成功与否, 返回后本参与者都已不在屏障内.
+func (b *DoubleBarrierByZookeeper) Leave(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path == "" {
+		return ErrNotEntered
+	}
+	path := b.path
+	b.path = ""
+
+	if err := b.waitLeft(ctx, path); err != nil {
+		b.reaper.abandon("", path)
+		return err
+	}
+	return nil
+}
+
+// waitReady 等待ready节点出现, 参与者已到齐时创建ready节点, 返回ready节点的czxid.
+func (b *DoubleBarrierByZookeeper) waitReady(ctx context.Context, name string) (int64, error) {
+	readyPath := b.dir + "/" + _DoubleBarrierReadyNode
+	var ownStat *zk.Stat
+	err := zkRetry(ctx, b.conn, func() error {
+		var err error
+		_, ownStat, err = b.conn.Exists(b.dir + "/" + name)
+		return err
+	})
+	if err != nil {
+		log.WithField("barrier", b.dir).WithError(err).Error("failed to enter double barrier")
+		return 0, err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			log.WithField("barrier", b.dir).Warn("timeout to enter double barrier")
+			return 0, err
+		}
+		children, watcher, err := zkSafeGetChildren(ctx, b.conn, b.dir, true)
+		if err != nil {
+			log.WithField("barrier", b.dir).WithError(err).Error("failed to enter double barrier")
+			return 0, err
+		}
+
+		var ready, found bool
+		count := 0
+		for _, child := range children {
+			switch {
+			case child == _DoubleBarrierReadyNode:
+				ready = true
+			case strings.HasPrefix(child, _DoubleBarrierParticipantPrefix):
+				count++
+				found = found || child == name
+			}
+		}
+		if !found {
+			log.WithField("barrier", b.dir).Warn("participant node lost while entering double barrier")
+			return 0, ErrBarrierNodeLost
+		}
+		if !ready && count >= b.participants {
+			// 参与者已到齐, 其他参与者可能同时创建
+			if _, err = zkSafeCreateWithDefaultDataFilled(ctx, b.conn, readyPath, 0, b.base.acl); err != nil && err != zk.ErrNodeExists {
+				log.WithField("barrier", b.dir).WithError(err).Error("failed to enter double barrier")
+				return 0, err
+			}
+			ready = true
+		}
+		if ready {
+			exists, stat, err := b.readyStat(ctx)
+			if err != nil {
+				log.WithField("barrier", b.dir).WithError(err).Error("failed to enter double barrier")
+				return 0, err
+			}
+			if !exists {
+				// ready节点已被上一轮最后离开的参与者删除, 重新检查
+				continue
+			}
+			if stat.Czxid < ownStat.Czxid {
+				// 之前一轮遗留的ready节点, 删除后重新等待参与者到齐
+				if err = zkSafeDelete(ctx, b.conn, readyPath, stat.Version); err != nil && err != zk.ErrNoNode && err != zk.ErrBadVersion {
+					log.WithField("barrier", b.dir).WithError(err).Error("failed to enter double barrier")
+					return 0, err
+				}
+				continue
+			}
+			return stat.Czxid, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			{
+				log.WithField("barrier", b.dir).Warn("timeout to enter double barrier")
+				return 0, ctx.Err()
+			}
+		case ev, ok := <-watcher:
+			{
+				if !ok {
+					return 0, zk.ErrClosing
+				}
+				if ev.Err != nil {
+					log.WithField("barrier", b.dir).WithError(ev.Err).Error("failed to enter double barrier")
+					return 0, ev.Err
+				}
+			}
+		}
+	}
+}
+
+// waitLeft 删除path并等待其他参与者都离开.
+// 序号最小的参与者最后离开, 其他参与者离开后等待序号最小的参与者, 序号最小的参与者等待序号最大的参与者,
+// 避免所有参与者监听同一个节点. 会话失效的参与者节点自动删除, 视为已经离开.
+// 本参与者的节点删除后创建的节点属于下一轮, 通过序号区分, 不再等待.
+func (b *DoubleBarrierByZookeeper) waitLeft(ctx context.Context, path string) error {
+	name := path[len(b.dir)+1:]
+	maxSeq := -1
+	for {
+		if err := ctx.Err(); err != nil {
+			log.WithField("barrier", b.dir).Warn("timeout to leave double barrier")
+			return err
+		}
+		children, _, err := zkSafeGetChildren(ctx, b.conn, b.dir, false)
+		if err != nil && err != zk.ErrNoNode {
+			log.WithField("barrier", b.dir).WithError(err).Error("failed to leave double barrier")
+			return err
+		}
+		participants := make([]string, 0, len(children))
+		found := false
+		for _, child := range children {
+			if strings.HasPrefix(child, _DoubleBarrierParticipantPrefix) {
+				participants = append(participants, child)
+				found = found || child == name
+			}
+		}
+		sort.Slice(participants, func(i, j int) bool {
+			return zkSequenceNum(participants[i]) < zkSequenceNum(participants[j])
+		})
+		if found || maxSeq < 0 {
+			// 本参与者的节点仍在时, 所有节点都属于本轮
+			if len(participants) > 0 {
+				maxSeq = zkSequenceNum(participants[len(participants)-1])
+			}
+		} else {
+			for len(participants) > 0 && zkSequenceNum(participants[len(participants)-1]) > maxSeq {
+				participants = participants[:len(participants)-1]
+			}
+		}
+
+		if len(participants) == 0 {
+			// 序号最小的参与者可能因会话失效而没有删除ready节点
+			b.deleteReady(ctx)
+			return nil
+		}
+		if len(participants) == 1 && participants[0] == name {
+			if err = zkSafeDelete(ctx, b.conn, path, -1); err != nil && err != zk.ErrNoNode {
+				log.WithField("barrier", b.dir).WithError(err).Error("failed to leave double barrier")
+				return err
+			}
+			b.deleteReady(ctx)
+			return nil
+		}
+
+		wait := participants[0]
+		if wait == name {
+			wait = participants[len(participants)-1]
+		} else if err = zkSafeDelete(ctx, b.conn, path, -1); err != nil && err != zk.ErrNoNode {
+			log.WithField("barrier", b.dir).WithError(err).Error("failed to leave double barrier")
+			return err
+		}
+		exists, watcher, err := zkSafeExists(ctx, b.conn, b.dir+"/"+wait, true)
+		if err != nil {
+			log.WithField("barrier", b.dir).WithError(err).Error("failed to leave double barrier")
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			{
+				log.WithField("barrier", b.dir).Warn("timeout to leave double barrier")
+				return ctx.Err()
+			}
+		case ev, ok := <-watcher:
+			{
+				if !ok {
+					return zk.ErrClosing
+				}
+				if ev.Err != nil {
+					log.WithField("barrier", b.dir).WithError(ev.Err).Error("failed to leave double barrier")
+					return ev.Err
+				}
+			}
+		}
+	}
+}
+
+// deleteReady 删除本轮的ready节点, 下一轮的参与者可能已经创建了新的ready节点, 通过czxid区分.
+func (b *DoubleBarrierByZookeeper) deleteReady(ctx context.Context) {
+	exists, stat, err := b.readyStat(ctx)
+	if err != nil || !exists || stat.Czxid != b.readyCzxid {
+		return
+	}
+	if err = zkSafeDelete(ctx, b.conn, b.dir+"/"+_DoubleBarrierReadyNode, stat.Version); err != nil && err != zk.ErrNoNode {
+		log.WithField("barrier", b.dir).WithError(err).Warn("failed to delete ready znode")
+	}
+}
+
+// readyStat 获取ready节点的状态.
+func (b *DoubleBarrierByZookeeper) readyStat(ctx context.Context) (bool, *zk.Stat, error) {
+	var exists bool
+	var stat *zk.Stat
+	err := zkRetry(ctx, b.conn, func() error {
+		var err error
+		exists, stat, err = b.conn.Exists(b.dir + "/" + _DoubleBarrierReadyNode)
+		return err
+	})
+	return exists, stat, err
+}
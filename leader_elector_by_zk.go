@@ -0,0 +1,258 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	_LeaderElectorCandidatePrefix = "candidate-"
+)
+
+var (
+	// ErrAlreadyCampaigning 已经在竞选或已经当选.
+	ErrAlreadyCampaigning = errors.New("already campaigning")
+	// ErrNoLeader 当前没有leader.
+	ErrNoLeader = errors.New("no leader")
+)
+
+// LeaderElectorByZookeeper 通过zookeeper实现的leader选举, 与DlockByZookeeper使用相同的临时顺序节点队列.
+// 每个候选者在<root>/<name>下创建一个临时顺序节点, 节点数据为候选者的标识, 序号最小的候选者当选.
+/*
+
+==> campaign
+n = create("<root>/<name>/candidate-", id, ephemeral|sequence)
+RETRY:
+    children = getChildren("<root>/<name>", watch=False)
+    if n is lowest znode in children:
+        elected, exist(n, watch=True) to detect leadership loss
+    else:
+        exist("<root>/<name>/candidate-" % (n - 1), watch=True)
+
+watch_event:
+	goto RETRY
+
+*/
+type LeaderElectorByZookeeper struct {
+	conn    ZKConn
+	base    *DlockByZookeeper
+	dir     string
+	id      string
+	reaper  *zkNodeReaper
+	changes chan bool
+
+	mu     sync.Mutex
+	path   string
+	leader bool
+	stopCh chan struct{}
+	cancel context.CancelFunc
+}
+
+// NewLeaderElectorByZookeeper 获取名为name的LeaderElectorByZookeeper实例, id为本候选者的标识, 选举目录不存在时自动创建,
+// opts同NewDlockByZookeeper (会话事件相关的配置不生效).
+func NewLeaderElectorByZookeeper(conn ZKConn, name, id string, opts ...DlockByZookeeperOption) (*LeaderElectorByZookeeper, error) {
+	base := newDlockByZookeeper(conn, opts...)
+	dir, err := base.lockDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = base.createLockDir(context.Background(), dir); err != nil {
+		log.WithField("election", name).WithError(err).Error("failed to create leader elector")
+		return nil, err
+	}
+	return &LeaderElectorByZookeeper{
+		conn:    conn,
+		base:    base,
+		dir:     dir,
+		id:      id,
+		reaper:  base.reaper,
+		changes: make(chan bool, 1),
+	}, nil
+}
+
+// Campaign 参与竞选, 阻塞直到当选, 或者ctx被取消或超时 (此时退出竞选).
+func (e *LeaderElectorByZookeeper) Campaign(ctx context.Context) error {
+	e.mu.Lock()
+	if e.cancel != nil {
+		e.mu.Unlock()
+		return ErrAlreadyCampaigning
+	}
+	// Resign时中止等待
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	e.cancel = cancel
+	e.mu.Unlock()
+
+	// 访问zookeeper期间不持有e.mu, 避免阻塞IsLeader等调用
+	path, err := e.base.createQueueNode(ctx, e.dir, _LeaderElectorCandidatePrefix, []byte(e.id))
+	if err != nil {
+		e.mu.Lock()
+		e.cancel = nil
+		e.mu.Unlock()
+		log.WithField("id", e.id).WithError(err).Error("failed to campaign")
+		return err
+	}
+	stopCh := make(chan struct{})
+	e.mu.Lock()
+	e.path = path
+	e.stopCh = stopCh
+	e.mu.Unlock()
+
+	seq := zkSequenceNum(path)
+	err = zkWaitPredecessor(ctx, e.conn, e.id, e.dir, func(children []string) string {
+		prevSeq := -1
+		prevSeqPath := ""
+		for _, child := range children {
+			_seq := zkSequenceNum(child)
+			if _seq < seq && _seq > prevSeq {
+				prevSeq = _seq
+				prevSeqPath = child
+			}
+		}
+		return prevSeqPath
+	})
+	if err != nil {
+		e.withdraw(path)
+		e.reaper.abandon(e.id, path)
+		return err
+	}
+
+	e.mu.Lock()
+	if e.path != path {
+		// 等待期间已经调用了Resign
+		e.mu.Unlock()
+		return ErrNoLeader
+	}
+	e.setLeader(true)
+	e.mu.Unlock()
+
+	go e.watchLeadership(path, stopCh)
+	return nil
+}
+
+// Resign 退出竞选, 如果已经当选则放弃leader身份.
+func (e *LeaderElectorByZookeeper) Resign() error {
+	e.mu.Lock()
+	path, cancel := e.path, e.cancel
+	e.mu.Unlock()
+	if path == "" {
+		if cancel != nil {
+			// 正在创建候选节点, 中止竞选, 已创建的节点由Campaign删除
+			cancel()
+		}
+		return nil
+	}
+
+	e.withdraw(path)
+	if err := zkSafeDelete(context.Background(), e.conn, path, -1); err != nil && err != zk.ErrNoNode {
+		log.WithField("id", e.id).WithError(err).Error("failed to resign")
+		return err
+	}
+	return nil
+}
+
+// IsLeader 本候选者当前是否为leader.
+func (e *LeaderElectorByZookeeper) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Changes 返回本候选者leader身份变化的通知, true表示当选, false表示失去leader身份.
+// 通知只保留最新的一次, 消费不及时时旧的通知会被丢弃.
+func (e *LeaderElectorByZookeeper) Changes() <-chan bool {
+	return e.changes
+}
+
+// Leader 返回当前leader的标识.
+func (e *LeaderElectorByZookeeper) Leader() (string, error) {
+	children, _, err := zkSafeGetChildren(context.Background(), e.conn, e.dir, false)
+	if err == zk.ErrNoNode {
+		return "", ErrNoLeader
+	}
+	if err != nil {
+		return "", err
+	}
+	lowestSeq := -1
+	lowestSeqPath := ""
+	for _, child := range children {
+		_seq := zkSequenceNum(child)
+		if _seq >= 0 && (lowestSeq < 0 || _seq < lowestSeq) {
+			lowestSeq = _seq
+			lowestSeqPath = child
+		}
+	}
+	if lowestSeqPath == "" {
+		return "", ErrNoLeader
+	}
+	data, err := zkSafeGet(context.Background(), e.conn, e.dir+"/"+lowestSeqPath)
+	if err == zk.ErrNoNode {
+		return "", ErrNoLeader
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// watchLeadership 监听本候选者的节点, 节点被删除 (如会话失效) 时失去leader身份.
+func (e *LeaderElectorByZookeeper) watchLeadership(path string, stopCh chan struct{}) {
+	for {
+		exists, watcher, err := zkSafeExists(context.Background(), e.conn, path, true)
+		if err != nil || !exists {
+			e.withdraw(path)
+			if err != nil {
+				// 无法确认leader身份时主动放弃, 避免节点残留阻塞其他候选者
+				log.WithField("id", e.id).WithError(err).Warn("lost leadership")
+				e.reaper.abandon(e.id, path)
+			}
+			return
+		}
+
+		select {
+		case <-stopCh:
+			{
+				return
+			}
+		case ev, ok := <-watcher:
+			{
+				if !ok || ev.Err != nil || ev.Type == zk.EventNodeDeleted {
+					log.WithField("id", e.id).WithError(ev.Err).Warn("lost leadership")
+					e.withdraw(path)
+					return
+				}
+			}
+		}
+	}
+}
+
+// withdraw 清除path对应的竞选状态, 如果已经当选则通知失去leader身份.
+func (e *LeaderElectorByZookeeper) withdraw(path string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.path != path {
+		return
+	}
+	close(e.stopCh)
+	e.cancel()
+	e.path = ""
+	e.stopCh = nil
+	e.cancel = nil
+	if e.leader {
+		e.setLeader(false)
+	}
+}
+
+// setLeader 更新leader身份并通知, 调用方需持有e.mu.
+func (e *LeaderElectorByZookeeper) setLeader(leader bool) {
+	e.leader = leader
+	select {
+	case <-e.changes:
+	default:
+	}
+	e.changes <- leader
+}
@@ -0,0 +1,134 @@
+package dlock
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Locker 分布式锁服务的通用接口.
+type Locker interface {
+	// TryLock 尝试获取分布式锁, 超时后就放弃 (不可重入锁).
+	TryLock(pid string, timeout int64 /* in secs */) (token string, acquired bool)
+	// Unlock 释放分布式锁.
+	Unlock(pid, token string)
+	// Close 释放Locker持有的连接.
+	Close()
+}
+
+// NewLockerFromURL 根据连接串建立连接, 并返回对应的分布式锁服务, 支持的连接串见
+// ParseRedisURL, ParseRedisSentinelURL 和 ParseZKURL.
+//
+// 基于redis的分布式锁额外支持expire参数 (如expire=30s), 用于指定锁的过期时间.
+func NewLockerFromURL(rawurl string) (Locker, error) {
+	// 多主机地址的端口可以不一致 (如zk://h1:2181,h2/dlock), url.Parse无法解析
+	u, err := parseMultiHostURL(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid locker url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "redis", "rediss", "redis-sentinel":
+		{
+			expire, err := popLockExpire(u)
+			if err != nil {
+				return nil, err
+			}
+			var rdb RedisConnInterface
+			if u.Scheme == "redis-sentinel" {
+				cfg, err := ParseRedisSentinelURL(u.String())
+				if err != nil {
+					return nil, err
+				}
+				rdb = EstablishRedisHAConnPool(cfg)
+			} else {
+				cfg, err := ParseRedisURL(u.String())
+				if err != nil {
+					return nil, err
+				}
+				rdb = EstablishRedisConn(cfg)
+			}
+			return &redisLocker{
+				rdb:    rdb,
+				dl:     NewDlockByRedis(rdb),
+				expire: expire,
+			}, nil
+		}
+	case "zk", "zookeeper":
+		{
+			cfg, err := ParseZKURL(rawurl)
+			if err != nil {
+				return nil, err
+			}
+			client, err := NewZKClient(cfg.ZKEndpoints, cfg.ZKSessionTimeout, WithZKConnRootPath(cfg.ZKRootPath))
+			if err != nil {
+				return nil, err
+			}
+			return &zkLocker{
+				client: client,
+				dl:     NewDlockByZookeeper(client, WithZKSessionEvents(client.Events()), WithZKSessionReestablish()),
+			}, nil
+		}
+	case "etcd":
+		{
+			return nil, errors.New("etcd backend is not implemented yet")
+		}
+	default:
+		{
+			return nil, fmt.Errorf("invalid locker url %q: %w %q", u.Redacted(), ErrUnsupportedScheme, u.Scheme)
+		}
+	}
+}
+
+// popLockExpire 从连接串中取出锁的过期时间 (in milliseconds).
+func popLockExpire(u *url.URL) (int64, error) {
+	q := u.Query()
+	s := q.Get("expire")
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Millisecond {
+		return 0, fmt.Errorf("invalid locker url %q: invalid value %q for parameter \"expire\"", u.Redacted(), s)
+	}
+	q.Del("expire")
+	u.RawQuery = q.Encode()
+	return int64(d / time.Millisecond), nil
+}
+
+type redisLocker struct {
+	rdb    RedisConnInterface
+	dl     *DlockByRedis
+	expire int64 // in milliseconds
+}
+
+func (l *redisLocker) TryLock(pid string, timeout int64) (string, bool) {
+	return l.dl.TryLock(pid, l.expire, timeout)
+}
+
+func (l *redisLocker) Unlock(pid, token string) {
+	l.dl.Unlock(pid, token)
+}
+
+func (l *redisLocker) Close() {
+	l.rdb.Close()
+}
+
+type zkLocker struct {
+	client *ZKClient
+	dl     *DlockByZookeeper
+}
+
+func (l *zkLocker) TryLock(pid string, timeout int64) (string, bool) {
+	return l.dl.TryLock(pid, timeout)
+}
+
+func (l *zkLocker) Unlock(pid, token string) {
+	l.dl.Unlock(pid, token)
+}
+
+func (l *zkLocker) Close() {
+	l.dl.Close()
+	l.client.Close()
+}
@@ -0,0 +1,336 @@
+package dlock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	_DefaultRedisPort    = "6379"
+	_DefaultSentinelPort = "26379"
+	_DefaultZKPort       = "2181"
+)
+
+var (
+	// ErrUnsupportedScheme 不支持的连接串协议.
+	ErrUnsupportedScheme = errors.New("unsupported scheme")
+)
+
+// ParseRedisURL 解析redis单机连接串, 格式如下:
+//
+//	redis://[user:pass@]host[:port][/db][?param=value&...]
+//	rediss://... (等价于tls=1)
+//
+// 支持的参数:
+//
+//	tls=1
+//	connect_timeout=2s, read_timeout=1s, write_timeout=1s
+//	max_idle=8, max_active=64, min_idle=4
+//	idle_timeout=5m, max_conn_lifetime=1h, wait_timeout=1s, role_check_idle=1m
+//
+// role_check_idle为负数 (如-1s) 时不检查角色.
+func ParseRedisURL(rawurl string) (*RedisConnPoolConfig, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid redis url %q: %w %q", u.Redacted(), ErrUnsupportedScheme, u.Scheme)
+	}
+
+	cfg := &RedisConnPoolConfig{}
+	cfg.RedisOpenTLS = u.Scheme == "rediss"
+	if strings.Contains(u.Host, ",") {
+		return nil, fmt.Errorf("invalid redis url %q: multiple hosts are only allowed in redis-sentinel urls", u.Redacted())
+	}
+	if cfg.RedisEndpoint, err = urlHostWithDefaultPort(u.Host, _DefaultRedisPort); err != nil {
+		return nil, fmt.Errorf("invalid redis url %q: %w", u.Redacted(), err)
+	}
+	if u.User != nil {
+		cfg.RedisUsername = u.User.Username()
+		cfg.RedisPassword, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if cfg.RedisDatabase, err = parseRedisDatabase(db); err != nil {
+			return nil, fmt.Errorf("invalid redis url %q: %w", u.Redacted(), err)
+		}
+	}
+
+	q := newURLQuery(u.Query())
+	if v, ok := q.bool("tls"); ok {
+		cfg.RedisOpenTLS = v
+	}
+	cfg.RedisConnectTimeout = q.msec("connect_timeout")
+	cfg.RedisReadTimeout = q.msec("read_timeout")
+	cfg.RedisWriteTimeout = q.msec("write_timeout")
+	cfg.RedisPoolMaxIdleConns = q.int("max_idle")
+	cfg.RedisPoolMaxActiveConns = q.int("max_active")
+	cfg.RedisRoleCheckIdleTime = q.signedMsec("role_check_idle")
+	cfg.RedisPoolIdleTimeout = q.msec("idle_timeout")
+	cfg.RedisPoolMaxConnLifetime = q.msec("max_conn_lifetime")
+	cfg.RedisPoolMinIdleConns = q.int("min_idle")
+	cfg.RedisPoolWaitTimeout = q.msec("wait_timeout")
+	if err = q.err(); err != nil {
+		return nil, fmt.Errorf("invalid redis url %q: %w", u.Redacted(), err)
+	}
+	return cfg, nil
+}
+
+// ParseRedisSentinelURL 解析redis哨兵连接串, 格式如下:
+//
+//	redis-sentinel://[user:pass@]s1[:port],s2[:port],s3[:port]/master_name[/db][?sentinel_password=xxx&tls=1&...]
+//
+// 其中user:pass为redis主节点的认证信息, 其余参数同ParseRedisURL.
+func ParseRedisSentinelURL(rawurl string) (*RedisHAConnPoolConfig, error) {
+	u, err := parseMultiHostURL(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis-sentinel url: %w", err)
+	}
+	if u.Scheme != "redis-sentinel" {
+		return nil, fmt.Errorf("invalid redis-sentinel url %q: %w %q", u.Redacted(), ErrUnsupportedScheme, u.Scheme)
+	}
+
+	cfg := &RedisHAConnPoolConfig{}
+	if cfg.SentinelEndpoints, err = urlHostsWithDefaultPort(u.Host, _DefaultSentinelPort); err != nil {
+		return nil, fmt.Errorf("invalid redis-sentinel url %q: %w", u.Redacted(), err)
+	}
+	if u.User != nil {
+		cfg.RedisMasterUsername = u.User.Username()
+		cfg.RedisMasterPassword, _ = u.User.Password()
+	}
+	segs := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segs) > 2 || segs[0] == "" {
+		return nil, fmt.Errorf("invalid redis-sentinel url %q: path must be /master_name[/db]", u.Redacted())
+	}
+	cfg.SentinelMasterName = segs[0]
+	if len(segs) == 2 {
+		if cfg.RedisDatabase, err = parseRedisDatabase(segs[1]); err != nil {
+			return nil, fmt.Errorf("invalid redis-sentinel url %q: %w", u.Redacted(), err)
+		}
+	}
+
+	q := newURLQuery(u.Query())
+	cfg.SentinelPassword = q.get("sentinel_password")
+	if v, ok := q.bool("tls"); ok {
+		cfg.SentinelOpenTLS = v
+	}
+	cfg.RedisConnectTimeout = q.msec("connect_timeout")
+	cfg.RedisReadTimeout = q.msec("read_timeout")
+	cfg.RedisWriteTimeout = q.msec("write_timeout")
+	cfg.RedisPoolMaxIdleConns = q.int("max_idle")
+	cfg.RedisPoolMaxActiveConns = q.int("max_active")
+	cfg.RedisRoleCheckIdleTime = q.signedMsec("role_check_idle")
+	cfg.RedisPoolIdleTimeout = q.msec("idle_timeout")
+	cfg.RedisPoolMaxConnLifetime = q.msec("max_conn_lifetime")
+	cfg.RedisPoolMinIdleConns = q.int("min_idle")
+	cfg.RedisPoolWaitTimeout = q.msec("wait_timeout")
+	if err = q.err(); err != nil {
+		return nil, fmt.Errorf("invalid redis-sentinel url %q: %w", u.Redacted(), err)
+	}
+	return cfg, nil
+}
+
+// ParseZKURL 解析zookeeper连接串, 格式如下:
+//
+//	zk://h1[:port],h2[:port],h3[:port][/root][?session=10s]
+//
+// root为锁服务的根路径 (含chroot, 如/app/dlock), 默认为/dlock.
+func ParseZKURL(rawurl string) (*ZKConnConfig, error) {
+	u, err := parseMultiHostURL(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zk url: %w", err)
+	}
+	if u.Scheme != "zk" && u.Scheme != "zookeeper" {
+		return nil, fmt.Errorf("invalid zk url %q: %w %q", u.Redacted(), ErrUnsupportedScheme, u.Scheme)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("invalid zk url %q: userinfo is not supported", u.Redacted())
+	}
+
+	cfg := &ZKConnConfig{}
+	if cfg.ZKEndpoints, err = urlHostsWithDefaultPort(u.Host, _DefaultZKPort); err != nil {
+		return nil, fmt.Errorf("invalid zk url %q: %w", u.Redacted(), err)
+	}
+	cfg.ZKRootPath = strings.TrimRight(u.Path, "/")
+	if cfg.ZKRootPath != "" && validZKPath(cfg.ZKRootPath) != nil {
+		return nil, fmt.Errorf("invalid zk url %q: invalid root path %q", u.Redacted(), u.Path)
+	}
+
+	q := newURLQuery(u.Query())
+	if d := q.duration("session"); d > 0 {
+		if d < time.Second {
+			return nil, fmt.Errorf("invalid zk url %q: session timeout must be at least 1s", u.Redacted())
+		}
+		cfg.ZKSessionTimeout = int64(d / time.Second)
+	}
+	if err = q.err(); err != nil {
+		return nil, fmt.Errorf("invalid zk url %q: %w", u.Redacted(), err)
+	}
+	return cfg, nil
+}
+
+// parseMultiHostURL 解析形如scheme://h1:port,h2,h3:port/path的连接串,
+// url.Parse只会校验最后一个冒号之后的端口, 无法处理部分主机省略端口的情形.
+func parseMultiHostURL(rawurl string) (*url.URL, error) {
+	i := strings.Index(rawurl, "://")
+	if i < 0 {
+		return url.Parse(rawurl)
+	}
+	authority := rawurl[i+3:]
+	if j := strings.IndexAny(authority, "/?#"); j >= 0 {
+		authority = authority[:j]
+	}
+	hosts := authority[strings.LastIndex(authority, "@")+1:]
+	placeholder := rawurl[:i+3] + authority[:len(authority)-len(hosts)] + "placeholder" + rawurl[i+3+len(authority):]
+	u, err := url.Parse(placeholder)
+	if err != nil {
+		return nil, err
+	}
+	u.Host = hosts
+	return u, nil
+}
+
+func parseRedisDatabase(s string) (int, error) {
+	db, err := strconv.Atoi(s)
+	if err != nil || db < 0 {
+		return 0, fmt.Errorf("invalid database %q", s)
+	}
+	return db, nil
+}
+
+func urlHostWithDefaultPort(host, defaultPort string) (string, error) {
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	h, p, err := net.SplitHostPort(host)
+	if err != nil {
+		// 没有指定端口
+		if strings.HasPrefix(host, "[") {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		return net.JoinHostPort(host, defaultPort), nil
+	}
+	if h == "" {
+		return "", fmt.Errorf("missing host in %q", host)
+	}
+	if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port in %q", host)
+	}
+	return host, nil
+}
+
+func urlHostsWithDefaultPort(hosts, defaultPort string) ([]string, error) {
+	if hosts == "" {
+		return nil, errors.New("missing host")
+	}
+	endpoints := make([]string, 0)
+	for _, host := range strings.Split(hosts, ",") {
+		endpoint, err := urlHostWithDefaultPort(host, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// urlQuery 解析连接串中的查询参数, 记录遇到的第一个错误.
+type urlQuery struct {
+	vals  url.Values
+	known map[string]bool
+	e     error
+}
+
+func newURLQuery(vals url.Values) *urlQuery {
+	return &urlQuery{vals: vals, known: make(map[string]bool)}
+}
+
+func (q *urlQuery) get(key string) string {
+	q.known[key] = true
+	return q.vals.Get(key)
+}
+
+func (q *urlQuery) bool(key string) (bool, bool) {
+	s := q.get(key)
+	if s == "" {
+		return false, false
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		q.setErr(key, s)
+		return false, false
+	}
+	return v, true
+}
+
+func (q *urlQuery) int(key string) int {
+	s := q.get(key)
+	if s == "" {
+		return 0
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		q.setErr(key, s)
+		return 0
+	}
+	return v
+}
+
+func (q *urlQuery) duration(key string) time.Duration {
+	s := q.get(key)
+	if s == "" {
+		return 0
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		q.setErr(key, s)
+		return 0
+	}
+	return v
+}
+
+func (q *urlQuery) msec(key string) int {
+	return int(q.duration(key) / time.Millisecond)
+}
+
+// signedMsec 同msec, 但允许负数.
+func (q *urlQuery) signedMsec(key string) int {
+	s := q.get(key)
+	if s == "" {
+		return 0
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		q.setErr(key, s)
+		return 0
+	}
+	if v < 0 && v > -time.Millisecond {
+		// 不足1ms的负数仍然视为负数
+		return -1
+	}
+	return int(v / time.Millisecond)
+}
+
+func (q *urlQuery) setErr(key, value string) {
+	if q.e == nil {
+		q.e = fmt.Errorf("invalid value %q for parameter %q", value, key)
+	}
+}
+
+// err 返回解析过程中遇到的第一个错误, 未被读取过的参数视为未知参数.
+func (q *urlQuery) err() error {
+	if q.e != nil {
+		return q.e
+	}
+	for key := range q.vals {
+		if !q.known[key] {
+			return fmt.Errorf("unknown parameter %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrInvalidLockName 锁名不合法.
+	ErrInvalidLockName = errors.New("invalid lock name")
+	// ErrNotEnoughReplicas 写入未被足够的从节点确认.
+	ErrNotEnoughReplicas = errors.New("not enough replicas acknowledged")
+)
+
+// MultiLock 由LockMany一次性获取的多把分布式锁, 通过Unlock一次性释放.
+type MultiLock struct {
+	names  []string
+	unlock func(ctx context.Context) error
+
+	once sync.Once
+	err  error
+}
+
+// Names 返回持有的锁名 (已去重并排序).
+func (ml *MultiLock) Names() []string {
+	names := make([]string, len(ml.names))
+	copy(names, ml.names)
+	return names
+}
+
+// Unlock 释放所有锁, 重复调用时返回第一次释放的结果.
+func (ml *MultiLock) Unlock(ctx context.Context) error {
+	ml.once.Do(func() {
+		ml.err = ml.unlock(ctx)
+	})
+	return ml.err
+}
+
+// normalizeLockNames 对锁名去重并排序, 所有调用方以相同的顺序加锁以避免死锁.
+func normalizeLockNames(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, ErrInvalidLockName
+	}
+	set := make(map[string]struct{}, len(names))
+	sorted := make([]string, 0, len(names))
+	for _, name := range names {
+		if name == "" {
+			return nil, ErrInvalidLockName
+		}
+		if _, ok := set[name]; ok {
+			continue
+		}
+		set[name] = struct{}{}
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
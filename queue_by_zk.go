@@ -0,0 +1,245 @@
+package dlock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	_QueueItemsDir   = "items"
+	_QueueClaimsDir  = "claims"
+	_QueueItemPrefix = "item-"
+)
+
+var (
+	// ErrItemNotClaimed 队列元素没有被本消费者认领, 或者认领已随会话失效.
+	ErrItemNotClaimed = errors.New("queue item not claimed")
+)
+
+// ZKQueueItem 从队列中认领的元素.
+type ZKQueueItem struct {
+	ID   string // 元素的节点名, 用于Ack
+	Data []byte
+}
+
+// QueueByZookeeper 通过zookeeper实现的持久化FIFO队列, 适用于元素较少的控制面队列 (单个元素不超过1MB).
+// 每个元素是<root>/<name>/items下的一个持久顺序节点, 消费者在<root>/<name>/claims下创建同名的临时节点认领元素,
+// 处理完成后Ack删除元素; 消费者会话失效时认领节点自动删除, 元素重新回到队列中, 因此每个元素至少被处理一次.
+/*
+
+==> put
+create("<root>/<name>/items/item-", data, persistent|sequence)
+
+==> take
+RETRY:
+    claims = getChildren("<root>/<name>/claims", watch=(no pending watch on claims))
+    items = getChildren("<root>/<name>/items", watch=(no pending watch on items))
+    for n in items ordered by sequence:
+        if n not in claims and create("<root>/<name>/claims/" % n, id, ephemeral) succeeds:
+            return n
+
+watch_event:
+	goto RETRY
+
+==> ack
+delete("<root>/<name>/items/" % n)
+delete("<root>/<name>/claims/" % n)
+
+*/
+type QueueByZookeeper struct {
+	conn      ZKConn
+	base      *DlockByZookeeper
+	itemsDir  string
+	claimsDir string
+	id        string
+}
+
+// NewQueueByZookeeper 获取名为name的QueueByZookeeper实例, 相关目录不存在时自动创建,
+// opts同NewDlockByZookeeper (会话事件相关的配置不生效).
+func NewQueueByZookeeper(conn ZKConn, name string, opts ...DlockByZookeeperOption) (*QueueByZookeeper, error) {
+	base := newDlockByZookeeper(conn, opts...)
+	dir, err := base.lockDir(name)
+	if err != nil {
+		return nil, err
+	}
+	q := &QueueByZookeeper{
+		conn:      conn,
+		base:      base,
+		itemsDir:  dir + "/" + _QueueItemsDir,
+		claimsDir: dir + "/" + _QueueClaimsDir,
+		id:        newZKGUID(),
+	}
+	for _, path := range []string{q.itemsDir, q.claimsDir} {
+		if err = base.createLockDir(context.Background(), path); err != nil {
+			log.WithField("queue", name).WithError(err).Error("failed to create queue")
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// Put 将data放入队列尾部, 返回元素的ID. 空的队列目录被回收时重新创建后重试, 直到ctx被取消或超时.
+// 连接断开后重试时, 之前的创建请求可能已经成功, 此时元素会重复入队.
+func (q *QueueByZookeeper) Put(ctx context.Context, data []byte) (string, error) {
+	for {
+		path, err := zkSafeCreate(ctx, q.conn, q.itemsDir+"/"+_QueueItemPrefix, data, zk.FlagSequence, q.base.acl)
+		if err == nil {
+			return path[len(q.itemsDir)+1:], nil
+		}
+		// 空的队列目录可能已被回收
+		if err == zk.ErrNoNode {
+			err = ctx.Err()
+		}
+		if err != nil {
+			log.WithField("queue", q.itemsDir).WithError(err).Error("failed to put item")
+			return "", err
+		}
+		if err = q.base.createLockDir(ctx, q.itemsDir); err != nil {
+			log.WithField("queue", q.itemsDir).WithError(err).Error("failed to put item")
+			return "", err
+		}
+	}
+}
+
+// Take 认领队列头部第一个未被认领的元素, 队列为空时阻塞, 直到有新的元素或者ctx被取消或超时.
+// 元素处理完成后调用Ack将其从队列中删除.
+func (q *QueueByZookeeper) Take(ctx context.Context) (*ZKQueueItem, error) {
+	// 监听只触发一次, 尚未触发的监听继续使用, 不重复设置
+	var claimsWatcher, itemsWatcher <-chan zk.Event
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		claims, watcher, err := q.children(ctx, q.claimsDir, claimsWatcher == nil)
+		if err != nil {
+			log.WithField("queue", q.itemsDir).WithError(err).Error("failed to take item")
+			return nil, err
+		}
+		if watcher != nil {
+			claimsWatcher = watcher
+		}
+		items, watcher, err := q.children(ctx, q.itemsDir, itemsWatcher == nil)
+		if watcher != nil {
+			itemsWatcher = watcher
+		}
+		if err != nil {
+			log.WithField("queue", q.itemsDir).WithError(err).Error("failed to take item")
+			return nil, err
+		}
+
+		item, err := q.claim(ctx, items, claims)
+		if err != nil {
+			log.WithField("queue", q.itemsDir).WithError(err).Error("failed to take item")
+			return nil, err
+		}
+		if item != nil {
+			return item, nil
+		}
+
+		// 等待新的元素, 或者其他消费者的认领被释放
+		var ev zk.Event
+		var ok bool
+		select {
+		case <-ctx.Done():
+			{
+				return nil, ctx.Err()
+			}
+		case ev, ok = <-claimsWatcher:
+			claimsWatcher = nil
+		case ev, ok = <-itemsWatcher:
+			itemsWatcher = nil
+		}
+		if !ok {
+			return nil, zk.ErrClosing
+		}
+		if ev.Err != nil {
+			log.WithField("queue", q.itemsDir).WithError(ev.Err).Error("failed to take item")
+			return nil, ev.Err
+		}
+	}
+}
+
+// Ack 确认元素已处理完成, 将其从队列中删除. 认领已随会话失效 (元素可能已被其他消费者认领) 时返回ErrItemNotClaimed.
+func (q *QueueByZookeeper) Ack(ctx context.Context, id string) error {
+	claimPath := q.claimsDir + "/" + id
+	owner, err := zkSafeGet(ctx, q.conn, claimPath)
+	if err == zk.ErrNoNode || (err == nil && !bytes.Equal(owner, []byte(q.id))) {
+		return ErrItemNotClaimed
+	}
+	if err != nil {
+		log.WithField("queue", q.itemsDir).WithError(err).Errorf("failed to ack item <%s>", id)
+		return err
+	}
+	// 先删除元素再删除认领, 避免元素被其他消费者再次认领
+	if err = zkSafeDelete(ctx, q.conn, q.itemsDir+"/"+id, -1); err != nil && err != zk.ErrNoNode {
+		log.WithField("queue", q.itemsDir).WithError(err).Errorf("failed to ack item <%s>", id)
+		return err
+	}
+	if err = zkSafeDelete(ctx, q.conn, claimPath, -1); err != nil && err != zk.ErrNoNode {
+		log.WithField("queue", q.itemsDir).WithError(err).Warnf("failed to delete claim of item <%s>", id)
+	}
+	return nil
+}
+
+// claim 按顺序认领items中第一个未被认领的元素, 没有可认领的元素时返回nil.
+func (q *QueueByZookeeper) claim(ctx context.Context, items, claims []string) (*ZKQueueItem, error) {
+	claimed := make(map[string]struct{}, len(claims))
+	for _, claim := range claims {
+		claimed[claim] = struct{}{}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return q.base.getSequenceNum(items[i], _QueueItemPrefix) < q.base.getSequenceNum(items[j], _QueueItemPrefix)
+	})
+
+	for _, item := range items {
+		if _, ok := claimed[item]; ok {
+			continue
+		}
+		claimPath := q.claimsDir + "/" + item
+		_, err := zkSafeCreate(ctx, q.conn, claimPath, []byte(q.id), zk.FlagEphemeral, q.base.acl)
+		if err == zk.ErrNoNode {
+			// 空的认领目录已被回收
+			if err = q.base.createLockDir(ctx, q.claimsDir); err != nil {
+				return nil, err
+			}
+			_, err = zkSafeCreate(ctx, q.conn, claimPath, []byte(q.id), zk.FlagEphemeral, q.base.acl)
+		}
+		// 被其他消费者抢先认领
+		if err == zk.ErrNodeExists {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := zkSafeGet(ctx, q.conn, q.itemsDir+"/"+item)
+		if err == zk.ErrNoNode {
+			// 获取子节点列表之后元素已被Ack
+			_ = zkSafeDelete(context.Background(), q.conn, claimPath, -1)
+			continue
+		}
+		if err != nil {
+			_ = zkSafeDelete(context.Background(), q.conn, claimPath, -1)
+			return nil, err
+		}
+		return &ZKQueueItem{ID: item, Data: data}, nil
+	}
+	return nil, nil
+}
+
+// children 获取dir的子节点, watch为true时设置监听, dir已被回收时重新创建.
+func (q *QueueByZookeeper) children(ctx context.Context, dir string, watch bool) ([]string, <-chan zk.Event, error) {
+	children, watcher, err := zkSafeGetChildren(ctx, q.conn, dir, watch)
+	if err != zk.ErrNoNode {
+		return children, watcher, err
+	}
+	if err = q.base.createLockDir(ctx, dir); err != nil {
+		return nil, nil, err
+	}
+	return zkSafeGetChildren(ctx, q.conn, dir, watch)
+}
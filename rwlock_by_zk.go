@@ -0,0 +1,163 @@
+package dlock
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	_RWLockReadPrefix  = "read-"
+	_RWLockWritePrefix = "write-"
+	_ZKSequenceLen     = 10
+)
+
+// RWLockByZookeeper 通过zookeeper实现的分布式读写锁, 读锁之间共享, 写锁独占.
+// 每把读写锁对应<root>/<name>下的一个排队目录, 该目录不能再用于LockMany.
+/*
+
+==> acquire read lock
+n = create("<root>/<name>/read-", "", ephemeral|sequence)
+RETRY:
+    children = getChildren("<root>/<name>", watch=False)
+    if no write- znode lower than n in children:
+        return
+    else:
+        exist(the nearest write- znode lower than n, watch=True)
+
+==> acquire write lock
+n = create("<root>/<name>/write-", "", ephemeral|sequence)
+RETRY:
+    children = getChildren("<root>/<name>", watch=False)
+    if n is lowest znode in children:
+        return
+    else:
+        exist(the nearest znode lower than n, watch=True)
+
+watch_event:
+	goto RETRY
+
+*/
+type RWLockByZookeeper struct {
+	conn   ZKConn
+	base   *DlockByZookeeper
+	dir    string
+	reaper *zkNodeReaper
+}
+
+// NewRWLockByZookeeper 获取名为name的RWLockByZookeeper实例, 排队目录不存在时自动创建, opts同NewDlockByZookeeper (会话事件相关的配置不生效).
+func NewRWLockByZookeeper(conn ZKConn, name string, opts ...DlockByZookeeperOption) (*RWLockByZookeeper, error) {
+	base := newDlockByZookeeper(conn, opts...)
+	dir, err := base.lockDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = base.createLockDir(context.Background(), dir); err != nil {
+		log.WithField("lock", name).WithError(err).Error("failed to create rwlock")
+		return nil, err
+	}
+	return &RWLockByZookeeper{
+		conn:   conn,
+		base:   base,
+		dir:    dir,
+		reaper: base.reaper,
+	}, nil
+}
+
+// TryRLock 尝试获取读锁, 超时后就放弃 (不可重入锁).
+func (rw *RWLockByZookeeper) TryRLock(pid string, timeout int64 /* in secs */) (token string, acquired bool) {
+	ctx, cancel := zkTimeoutContext(timeout)
+	defer cancel()
+	return rw.TryRLockContext(ctx, pid)
+}
+
+// TryRLockContext 尝试获取读锁, ctx被取消或超时后就放弃 (不可重入锁).
+func (rw *RWLockByZookeeper) TryRLockContext(ctx context.Context, pid string) (token string, acquired bool) {
+	path, err := rw.acquire(ctx, pid, _RWLockReadPrefix)
+	if err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// TryLock 尝试获取写锁, 超时后就放弃 (不可重入锁).
+func (rw *RWLockByZookeeper) TryLock(pid string, timeout int64 /* in secs */) (token string, acquired bool) {
+	ctx, cancel := zkTimeoutContext(timeout)
+	defer cancel()
+	return rw.TryLockContext(ctx, pid)
+}
+
+// TryLockContext 尝试获取写锁, ctx被取消或超时后就放弃 (不可重入锁).
+func (rw *RWLockByZookeeper) TryLockContext(ctx context.Context, pid string) (token string, acquired bool) {
+	path, err := rw.acquire(ctx, pid, _RWLockWritePrefix)
+	if err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// Unlock 释放读锁或写锁.
+func (rw *RWLockByZookeeper) Unlock(pid, token string) {
+	if err := zkSafeDelete(context.Background(), rw.conn, token, -1); err != nil {
+		log.WithField("pid", pid).WithError(err).Error("failed to release lock")
+	}
+}
+
+func (rw *RWLockByZookeeper) acquire(ctx context.Context, pid, prefix string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		log.WithField("pid", pid).Warn("timeout to acquire lock")
+		return "", err
+	}
+	path, err := rw.base.createQueueNode(ctx, rw.dir, prefix, nil)
+	if err != nil {
+		log.WithField("pid", pid).WithError(err).Error("failed to acquire lock")
+		return "", err
+	}
+
+	seq := zkSequenceNum(path)
+	// 读锁只需等待前面最近的写锁, 写锁需要等待前面最近的任意锁
+	onlyWriters := prefix == _RWLockReadPrefix
+	err = zkWaitPredecessor(ctx, rw.conn, pid, rw.dir, func(children []string) string {
+		prevSeq := -1
+		prevSeqPath := ""
+		for _, child := range children {
+			if onlyWriters && !strings.HasPrefix(child, _RWLockWritePrefix) {
+				continue
+			}
+			_seq := zkSequenceNum(child)
+			if _seq < seq && _seq > prevSeq {
+				prevSeq = _seq
+				prevSeqPath = child
+			}
+		}
+		return prevSeqPath
+	})
+	if err != nil {
+		rw.reaper.abandon(pid, path)
+		return "", err
+	}
+	return path, nil
+}
+
+// zkTimeoutContext 将以秒为单位的超时时间转换为ctx, 不大于0时按1秒处理.
+func zkTimeoutContext(timeout int64 /* in secs */) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = 1
+	}
+	return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+}
+
+// zkSequenceNum 解析顺序节点名末尾由zookeeper追加的10位序号, 同一目录下不同前缀的节点共用一个序号计数器.
+func zkSequenceNum(path string) int {
+	if len(path) < _ZKSequenceLen {
+		return -1
+	}
+	num, err := strconv.Atoi(path[len(path)-_ZKSequenceLen:])
+	if err != nil {
+		return -1
+	}
+	return num
+}
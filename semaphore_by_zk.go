@@ -0,0 +1,149 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	_SemaphoreLocksDir    = "locks"
+	_SemaphoreLeasesDir   = "leases"
+	_SemaphoreLeasePrefix = "lease-"
+)
+
+var (
+	// ErrInvalidMaxLeases 信号量的租约数不合法.
+	ErrInvalidMaxLeases = errors.New("invalid max leases")
+)
+
+// SemaphoreByZookeeper 通过zookeeper实现的分布式信号量, 最多同时发放maxLeases个租约.
+// 每个租约是<root>/<name>/leases下的一个临时节点, 持有者会话失效时租约自动回收;
+// 申请租约前先获取<root>/<name>/locks下的分布式锁, 保证租约计数没有竞争且申请者按先来后到排队.
+/*
+
+==> acquire lease
+lock("<root>/<name>/locks")
+n = create("<root>/<name>/leases/lease-", "", ephemeral|sequence)
+RETRY:
+    children = getChildren("<root>/<name>/leases", watch=True)
+    if n is among the lowest maxLeases znodes in children:
+        unlock("<root>/<name>/locks")
+        return
+
+watch_event:
+	goto RETRY
+
+*/
+type SemaphoreByZookeeper struct {
+	conn      ZKConn
+	lock      *DlockByZookeeper
+	locksDir  string
+	leasesDir string
+	maxLeases int
+}
+
+// NewSemaphoreByZookeeper 获取名为name的SemaphoreByZookeeper实例, 相关目录不存在时自动创建.
+// 使用同一个信号量的所有客户端必须使用相同的maxLeases, opts同NewDlockByZookeeper (会话事件相关的配置不生效).
+func NewSemaphoreByZookeeper(conn ZKConn, name string, maxLeases int, opts ...DlockByZookeeperOption) (*SemaphoreByZookeeper, error) {
+	if maxLeases <= 0 {
+		return nil, ErrInvalidMaxLeases
+	}
+	lock := newDlockByZookeeper(conn, opts...)
+	dir, err := lock.lockDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range []string{dir + "/" + _SemaphoreLocksDir, dir + "/" + _SemaphoreLeasesDir} {
+		if err := lock.createLockDir(context.Background(), path); err != nil {
+			log.WithField("semaphore", name).WithError(err).Error("failed to create semaphore")
+			return nil, err
+		}
+	}
+	return &SemaphoreByZookeeper{
+		conn:      conn,
+		lock:      lock,
+		locksDir:  dir + "/" + _SemaphoreLocksDir,
+		leasesDir: dir + "/" + _SemaphoreLeasesDir,
+		maxLeases: maxLeases,
+	}, nil
+}
+
+// TryAcquire 尝试获取一个租约, 超时后就放弃.
+func (s *SemaphoreByZookeeper) TryAcquire(pid string, timeout int64 /* in secs */) (lease string, acquired bool) {
+	ctx, cancel := zkTimeoutContext(timeout)
+	defer cancel()
+	return s.TryAcquireContext(ctx, pid)
+}
+
+// TryAcquireContext 尝试获取一个租约, ctx被取消或超时后就放弃.
+func (s *SemaphoreByZookeeper) TryAcquireContext(ctx context.Context, pid string) (lease string, acquired bool) {
+	lockPath, err := s.lock.acquire(ctx, pid, s.locksDir)
+	if err != nil {
+		return "", false
+	}
+	defer s.lock.Unlock(pid, lockPath)
+
+	path, err := s.lock.createQueueNode(ctx, s.leasesDir, _SemaphoreLeasePrefix, nil)
+	if err != nil {
+		log.WithField("pid", pid).WithError(err).Error("failed to acquire lease")
+		return "", false
+	}
+	if err = s.wait(ctx, pid, path); err != nil {
+		s.lock.reaper.abandon(pid, path)
+		return "", false
+	}
+	return path, true
+}
+
+// Release 归还租约.
+func (s *SemaphoreByZookeeper) Release(pid, lease string) {
+	if err := zkSafeDelete(context.Background(), s.conn, lease, -1); err != nil {
+		log.WithField("pid", pid).WithError(err).Error("failed to release lease")
+	}
+}
+
+// wait 等待path排进租约目录中序号最小的maxLeases个节点, 租约目录有变化时才重新检查.
+func (s *SemaphoreByZookeeper) wait(ctx context.Context, pid, path string) error {
+	seq := zkSequenceNum(path)
+	for {
+		if err := ctx.Err(); err != nil {
+			log.WithField("pid", pid).Warn("timeout to acquire lease")
+			return err
+		}
+		children, watcher, err := zkSafeGetChildren(ctx, s.conn, s.leasesDir, true)
+		if err != nil {
+			log.WithField("pid", pid).WithError(err).Error("failed to acquire lease")
+			return err
+		}
+		seqs := make([]int, 0, len(children))
+		for _, child := range children {
+			seqs = append(seqs, zkSequenceNum(child))
+		}
+		sort.Ints(seqs)
+		if idx := sort.SearchInts(seqs, seq); idx < s.maxLeases {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			{
+				log.WithField("pid", pid).Warn("timeout to acquire lease")
+				return ctx.Err()
+			}
+		case ev, ok := <-watcher:
+			{
+				if !ok {
+					return zk.ErrClosing
+				}
+				if ev.Err != nil {
+					log.WithField("pid", pid).WithError(ev.Err).Error("failed to acquire lease")
+					return ev.Err
+				}
+			}
+		}
+	}
+}
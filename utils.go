@@ -5,7 +5,7 @@ import (
 	"testing"
 )
 
-func SkipAutoTest(t *testing.T) {
+func SkipAutoTest(t testing.TB) {
 	if os.Getenv("AUTO_TEST") == "true" {
 		t.Skip("Skip unit testing in AUTO_TEST mode")
 	}